@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminTemplatesPage lists the stored template documents.
+func adminTemplatesPage(c *gin.Context) {
+	raw, err := GetRawTemplateDocuments()
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Error loading templates")
+		return
+	}
+	sort.Slice(raw, func(i, j int) bool {
+		return fmt.Sprintf("%v", raw[i]["docId"]) < fmt.Sprintf("%v", raw[j]["docId"])
+	})
+	data := topNavData()
+	data["templates"] = raw
+	c.HTML(http.StatusOK, "templates.html", data)
+}
+
+// adminTemplateEditPage opens the editor for ?id=<docId>, or for a new
+// template when no id is given.
+func adminTemplateEditPage(c *gin.Context) {
+	docID := c.Query("id")
+	doc := map[string]interface{}{
+		"templateName": "",
+		"template":     map[string]interface{}{"id": "", "version": "V01"},
+	}
+	revision := 0
+	if docID != "" {
+		stored, _, err := GetRawTemplateDocument(docID)
+		if err != nil {
+			c.String(http.StatusNotFound, "Not found")
+			return
+		}
+		doc = stored
+		revision = templateRevision(stored)
+	}
+	data := topNavData()
+	data["docId"] = docID
+	data["revision"] = revision
+	data["document"] = doc
+	c.HTML(http.StatusOK, "template_edit.html", data)
+}
+
+// candidateFromRequest reads the template document being edited from a JSON
+// body of the form {"docId": ..., "document": {...}}.
+func candidateFromRequest(c *gin.Context) (map[string]interface{}, int, error) {
+	var req struct {
+		DocID    string                 `json:"docId"`
+		Revision int                    `json:"revision"`
+		Document map[string]interface{} `json:"document"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		return nil, 0, fmt.Errorf("invalid JSON")
+	}
+	if req.Document == nil {
+		return nil, 0, fmt.Errorf("missing document")
+	}
+	req.Document["docId"] = req.DocID
+	return req.Document, req.Revision, nil
+}
+
+// adminTemplatePreview renders the form of the template document posted in
+// the "document" form field, for the editor's preview frame.
+func adminTemplatePreview(c *gin.Context) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(c.PostForm("document")), &doc); err != nil {
+		c.String(http.StatusBadRequest, fmt.Sprintf("Invalid JSON: %v", err))
+		return
+	}
+	doc["docId"] = c.PostForm("docId")
+	t, err := BuildCandidateTemplate(doc)
+	if err != nil {
+		c.String(http.StatusBadRequest, fmt.Sprintf("Error: %v", err))
+		return
+	}
+	jobSpecIDs, _ := GetJobSpecIDs()
+	c.HTML(http.StatusOK, "form.html", gin.H{"form": t, "jobSpecIDs": jobSpecIDs, "preview": true})
+}
+
+// adminTemplateLint lints the template document being edited.
+func adminTemplateLint(c *gin.Context) {
+	doc, _, err := candidateFromRequest(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	issues, err := LintCandidate(doc)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Error loading templates")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"issues": issues, "errorCount": lintErrorCount(issues)})
+}
+
+// adminTemplateSave lints and saves the template document being edited as a
+// new revision. Templates with lint errors are not saved.
+func adminTemplateSave(c *gin.Context) {
+	doc, revision, err := candidateFromRequest(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	issues, err := LintCandidate(doc)
+	if err != nil {
+		log.Printf("Error loading templates: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error loading templates"})
+		return
+	}
+	if n := lintErrorCount(issues); n > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"issues": issues, "errorCount": n, "error": "template has lint errors"})
+		return
+	}
+	docID, _ := doc["docId"].(string)
+	saved, err := SaveTemplateDocument(docID, doc, revision)
+	switch {
+	case errors.Is(err, errTemplateConflict):
+		c.JSON(http.StatusConflict, gin.H{"issues": issues, "error": err.Error()})
+	case err != nil:
+		log.Printf("Error saving template %s: %v", docID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"issues": issues, "error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, gin.H{"issues": issues, "revision": saved})
+	}
+}
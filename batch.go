@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// A batch commit writes several documents, e.g. a new DS, the PS that uses it
+// and the IS that ingests it, all or nothing. Every document is prepared
+// first; references between documents of the same batch count as existing.
+// Only when all are valid are they written, in one Couchbase transaction.
+
+// BatchItem is one document of a batch, submitted as from the form of
+// TemplateName. With Create set it must not exist yet.
+type BatchItem struct {
+	TemplateName string                 `json:"templateName"`
+	Document     map[string]interface{} `json:"document"`
+	Create       bool                   `json:"create,omitempty"`
+}
+
+// BatchResult reports one document of a batch.
+type BatchResult struct {
+	Index  int    `json:"index"`
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status,omitempty"` // created or replaced
+	Error  string `json:"error,omitempty"`
+}
+
+// preparedItem is a batch document that is ready to be written.
+type preparedItem struct {
+	id       string
+	document map[string]interface{}
+	create   bool
+	expiry   time.Duration
+	expires  bool // the template binds the expiry to a TTL tier
+}
+
+// PrepareBatch prepares every document of a batch. It returns the prepared
+// documents, or nil and the result of each document when any is invalid.
+func PrepareBatch(cluster *gocb.Cluster, items []BatchItem) ([]preparedItem, []BatchResult, error) {
+	templates, err := GetFormTemplates()
+	if err != nil {
+		return nil, nil, err
+	}
+	byName := make(map[string]FormTemplate, len(templates))
+	for _, t := range templates {
+		byName[t.TemplateName] = t
+	}
+	results := make([]BatchResult, len(items))
+	prepared := make([]preparedItem, len(items))
+	pending := make(map[string]map[string]interface{}, len(items))
+	failed := false
+	for i, item := range items {
+		results[i].Index = i
+		t, ok := byName[item.TemplateName]
+		if !ok {
+			results[i].Error = fmt.Sprintf("template not found: %s", item.TemplateName)
+			failed = true
+			continue
+		}
+		doc, err := t.buildDocument(item.Document)
+		if err != nil {
+			results[i].Error = err.Error()
+			failed = true
+			continue
+		}
+		id, _ := doc["id"].(string)
+		results[i].ID = id
+		switch {
+		case id == "":
+			results[i].Error = "the id field is missing"
+			failed = true
+			continue
+		case pending[id] != nil:
+			results[i].Error = fmt.Sprintf("%s appears more than once in the batch", id)
+			failed = true
+			continue
+		}
+		pending[id] = doc
+		prepared[i] = preparedItem{id: id, document: doc, create: item.Create}
+	}
+	for i, item := range items {
+		if results[i].Error != "" {
+			continue
+		}
+		t := byName[item.TemplateName]
+		if err := t.CheckReferences(cluster, prepared[i].document, pending); err != nil {
+			results[i].Error = err.Error()
+			failed = true
+			continue
+		}
+		doc, err := t.ApplyLifecycle(cluster, prepared[i].document)
+		if err != nil {
+			results[i].Error = err.Error()
+			failed = true
+			continue
+		}
+		prepared[i].document = doc
+		if prepared[i].expiry, prepared[i].expires, err = t.DocumentExpiry(doc); err != nil {
+			results[i].Error = err.Error()
+			failed = true
+		}
+	}
+	if failed {
+		return nil, results, nil
+	}
+	return prepared, results, nil
+}
+
+// CommitBatch writes the prepared documents to RUNTIME in one transaction.
+// If any write fails, none of them is kept.
+func CommitBatch(cluster *gocb.Cluster, items []preparedItem, results []BatchResult) error {
+	// the transaction and the documents it writes must share the connection
+	collection := cluster.Bucket(GetCBCredentials().CBBucket).Collection("RUNTIME")
+	statuses := make([]string, len(items))
+	_, err := cluster.Transactions().Run(func(ctx *gocb.TransactionAttemptContext) error {
+		for i, item := range items {
+			existing, err := ctx.Get(collection, item.id)
+			switch {
+			case errors.Is(err, gocb.ErrDocumentNotFound):
+				if _, err := ctx.Insert(collection, item.id, item.document); err != nil {
+					return fmt.Errorf("failed to insert %s: %w", item.id, err)
+				}
+				statuses[i] = "created"
+			case err != nil:
+				return fmt.Errorf("failed to read %s: %w", item.id, err)
+			case item.create:
+				return fmt.Errorf("%s already exists", item.id)
+			default:
+				if _, err := ctx.Replace(existing, item.document); err != nil {
+					return fmt.Errorf("failed to replace %s: %w", item.id, err)
+				}
+				statuses[i] = "replaced"
+			}
+		}
+		return nil
+	}, &gocb.TransactionOptions{})
+	if err != nil {
+		return fmt.Errorf("transaction rolled back: %w", err)
+	}
+	for i := range results {
+		results[i].Status = statuses[i]
+	}
+	// transactions cannot set an expiry, so it is set once they are committed
+	for i, item := range items {
+		if !item.expires {
+			continue
+		}
+		if _, err := collection.Touch(item.id, item.expiry, &gocb.TouchOptions{}); err != nil {
+			log.Printf("Failed to set the expiry of %s: %v", item.id, err)
+			results[i].Error = fmt.Sprintf("committed, but failed to set the expiry: %v", err)
+		}
+	}
+	return nil
+}
+
+// commitBatchHandler commits {"documents": [BatchItem...]}. Invalid
+// documents are reported with 400 and nothing is written; a failed
+// transaction is reported with 409 and rolled back.
+func commitBatchHandler(c *gin.Context) {
+	var req struct {
+		Documents []BatchItem `json:"documents"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.String(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if len(req.Documents) == 0 {
+		c.String(http.StatusBadRequest, "No documents")
+		return
+	}
+	cluster := GetConnection(GetCBCredentials())
+	defer cluster.Close(nil)
+	prepared, results, err := PrepareBatch(cluster, req.Documents)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Error loading forms")
+		return
+	}
+	if prepared == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"committed": false, "error": "invalid documents, nothing was written", "results": results})
+		return
+	}
+	if err := CommitBatch(cluster, prepared, results); err != nil {
+		log.Printf("Batch commit failed: %v", err)
+		c.JSON(http.StatusConflict, gin.H{"committed": false, "error": err.Error(), "results": results})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"committed": true, "results": results})
+}
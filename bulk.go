@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// Bulk generation creates one document per combination of the values chosen
+// for the matrix fields, e.g. every region × subset × subDocType. Each
+// document goes through PrepareDocument exactly as a form commit would.
+
+// maxBulkDocuments caps the size of a matrix.
+const maxBulkDocuments = 500
+
+// BulkRequest is a template, the values shared by every generated document
+// and the values to combine.
+type BulkRequest struct {
+	TemplateName string                 `json:"templateName"`
+	Values       map[string]interface{} `json:"values"`
+	Matrix       map[string][]string    `json:"matrix"`
+	Overwrite    bool                   `json:"overwrite"`
+}
+
+// GeneratedDocument is one document of a bulk generation and, after a commit,
+// what happened to it.
+type GeneratedDocument struct {
+	ID       string                 `json:"id"`
+	Values   map[string]string      `json:"values"` // the matrix combination
+	Document map[string]interface{} `json:"document,omitempty"`
+	Exists   bool                   `json:"exists,omitempty"`
+	Status   string                 `json:"status,omitempty"` // created, replaced, exists or failed
+	Error    string                 `json:"error,omitempty"`
+
+	expiry time.Duration
+}
+
+// multipleField reports whether a field of t holds a list of values rather
+// than a single choice, so it cannot be a matrix field.
+func (t FormTemplate) multipleField(key string) bool {
+	if key == "job_spec_ids" {
+		return true
+	}
+	fn, ok := namedFunctions[t.Functions[key]]
+	return ok && fn.multiple
+}
+
+// ExpandMatrix returns every combination of the matrix values, varying the
+// last field (by name) fastest.
+func ExpandMatrix(matrix map[string][]string) ([]map[string]string, error) {
+	keys := make([]string, 0, len(matrix))
+	total := 1
+	for key, values := range matrix {
+		if len(values) == 0 {
+			continue
+		}
+		keys = append(keys, key)
+		total *= len(values)
+		if total > maxBulkDocuments {
+			return nil, fmt.Errorf("the matrix makes more than %d documents", maxBulkDocuments)
+		}
+	}
+	sort.Strings(keys)
+	combos := []map[string]string{{}}
+	for _, key := range keys {
+		next := make([]map[string]string, 0, len(combos)*len(matrix[key]))
+		for _, combo := range combos {
+			for _, value := range matrix[key] {
+				c := make(map[string]string, len(combo)+1)
+				for k, v := range combo {
+					c[k] = v
+				}
+				c[key] = value
+				next = append(next, c)
+			}
+		}
+		combos = next
+	}
+	return combos, nil
+}
+
+// baseDocument returns the template defaults of t as a document: constants
+// and JSON fields, with selects left empty.
+func (t FormTemplate) baseDocument() map[string]interface{} {
+	doc := make(map[string]interface{}, len(t.Fields))
+	for key, value := range t.Fields {
+		if strings.HasPrefix(key, "@") {
+			var parsed interface{}
+			if s, ok := value.(string); ok && json.Unmarshal([]byte(s), &parsed) == nil {
+				doc[strings.TrimPrefix(key, "@")] = parsed
+			}
+			continue
+		}
+		if _, ok := t.SelectFields[key]; ok {
+			doc[key] = ""
+			continue
+		}
+		doc[key] = value
+	}
+	return doc
+}
+
+// GenerateDocuments prepares the documents of a bulk request, without
+// storing them. A document that cannot be prepared carries the error.
+func (t FormTemplate) GenerateDocuments(req BulkRequest) ([]GeneratedDocument, error) {
+	for key := range req.Matrix {
+		if _, ok := t.Fields[key]; !ok {
+			return nil, fmt.Errorf("%s is not a field of %s", key, t.TemplateName)
+		}
+		if t.DisabledFields[key] {
+			return nil, fmt.Errorf("%s is not editable", key)
+		}
+		if t.multipleField(key) {
+			return nil, fmt.Errorf("%s holds a list and cannot be combined", key)
+		}
+	}
+	combos, err := ExpandMatrix(req.Matrix)
+	if err != nil {
+		return nil, err
+	}
+	// one connection serves the checks of every combination
+	cluster := GetConnection(GetCBCredentials())
+	defer cluster.Close(nil)
+	docs := make([]GeneratedDocument, 0, len(combos))
+	seen := make(map[string]int)
+	for _, combo := range combos {
+		values := t.baseDocument()
+		for key, value := range req.Values {
+			values[key] = value
+		}
+		for key, value := range combo {
+			values[key] = value
+		}
+		gen := GeneratedDocument{Values: combo}
+		prepared, err := t.PrepareDocument(cluster, values)
+		if err != nil {
+			gen.Error = err.Error()
+			docs = append(docs, gen)
+			continue
+		}
+		gen.ID, _ = prepared["id"].(string)
+		gen.Document = prepared
+		gen.expiry, _, err = t.DocumentExpiry(prepared)
+		switch {
+		case err != nil:
+			gen.Error = err.Error()
+		case gen.ID == "":
+			gen.Error = "the document has no id"
+		case seen[gen.ID] > 0:
+			gen.Error = fmt.Sprintf("same id as document %d; add the varying fields to the id", seen[gen.ID])
+		default:
+			seen[gen.ID] = len(docs) + 1
+		}
+		docs = append(docs, gen)
+	}
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	if len(ids) > 0 {
+		existing, err := lookupReferencedDocuments(cluster, "RUNTIME", ids)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check existing documents: %w", err)
+		}
+		for i := range docs {
+			_, docs[i].Exists = existing[docs[i].ID]
+		}
+	}
+	return docs, nil
+}
+
+// CommitGenerated stores the generated documents that have no error. Existing
+// documents are only replaced when overwrite is set.
+func CommitGenerated(docs []GeneratedDocument, overwrite bool) []GeneratedDocument {
+	collection := runtimeCollection()
+	for i := range docs {
+		gen := &docs[i]
+		if gen.Error != "" {
+			gen.Status = "failed"
+			continue
+		}
+		var err error
+		if overwrite {
+			_, err = collection.Upsert(gen.ID, gen.Document, &gocb.UpsertOptions{Expiry: gen.expiry})
+		} else {
+			_, err = collection.Insert(gen.ID, gen.Document, &gocb.InsertOptions{Expiry: gen.expiry})
+		}
+		switch {
+		case errors.Is(err, gocb.ErrDocumentExists):
+			gen.Status = "exists"
+		case err != nil:
+			gen.Status = "failed"
+			gen.Error = err.Error()
+		case gen.Exists:
+			gen.Status = "replaced"
+		default:
+			gen.Status = "created"
+		}
+	}
+	return docs
+}
+
+// bulkDocuments reads a BulkRequest and generates its documents, writing the
+// error response itself when that fails.
+func bulkDocuments(c *gin.Context) (BulkRequest, []GeneratedDocument, bool) {
+	var req BulkRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.String(http.StatusBadRequest, "Invalid JSON")
+		return req, nil, false
+	}
+	t, err := FindFormTemplate(req.TemplateName)
+	if err != nil {
+		c.String(http.StatusNotFound, fmt.Sprintf("Error: %v", err))
+		return req, nil, false
+	}
+	docs, err := t.GenerateDocuments(req)
+	if err != nil {
+		c.String(http.StatusBadRequest, fmt.Sprintf("Error: %v", err))
+		return req, nil, false
+	}
+	return req, docs, true
+}
+
+// bulkPreview returns the documents a BulkRequest would create.
+func bulkPreview(c *gin.Context) {
+	if _, docs, ok := bulkDocuments(c); ok {
+		c.JSON(http.StatusOK, docs)
+	}
+}
+
+// bulkCommit creates the documents of a BulkRequest and returns the result of
+// each.
+func bulkCommit(c *gin.Context) {
+	req, docs, ok := bulkDocuments(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, CommitGenerated(docs, req.Overwrite))
+}
+
+// bulkPage shows the bulk generation form for ?template=<name>.
+func bulkPage(c *gin.Context) {
+	templates, err := GetFormTemplates()
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Error loading forms")
+		return
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].TemplateName < templates[j].TemplateName })
+	data := topNavData()
+	data["forms"] = templates
+	if name := c.Query("template"); name != "" {
+		t, err := FindFormTemplate(name)
+		if err != nil {
+			c.String(http.StatusNotFound, "Not found")
+			return
+		}
+		multiple := make(map[string]bool)
+		for key := range t.SelectFields {
+			multiple[key] = t.multipleField(key)
+		}
+		for key := range t.Typeahead {
+			multiple[key] = t.multipleField(key)
+		}
+		data["form"] = t
+		data["multiple"] = multiple
+	}
+	c.HTML(http.StatusOK, "bulk.html", data)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandMatrix(t *testing.T) {
+	tests := []struct {
+		name   string
+		matrix map[string][]string
+		want   []map[string]string
+	}{
+		{
+			name:   "empty",
+			matrix: map[string][]string{},
+			want:   []map[string]string{{}},
+		},
+		{
+			name:   "one field",
+			matrix: map[string][]string{"region": {"CONUS", "ALASKA"}},
+			want:   []map[string]string{{"region": "CONUS"}, {"region": "ALASKA"}},
+		},
+		{
+			name: "last field varies fastest",
+			matrix: map[string][]string{
+				"model":  {"HRRR", "RAP"},
+				"region": {"CONUS", "ALASKA"},
+			},
+			want: []map[string]string{
+				{"model": "HRRR", "region": "CONUS"},
+				{"model": "HRRR", "region": "ALASKA"},
+				{"model": "RAP", "region": "CONUS"},
+				{"model": "RAP", "region": "ALASKA"},
+			},
+		},
+		{
+			name: "fields without values are left out",
+			matrix: map[string][]string{
+				"model":  {"HRRR"},
+				"region": {},
+			},
+			want: []map[string]string{{"model": "HRRR"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExpandMatrix(tt.matrix)
+			if err != nil {
+				t.Fatalf("ExpandMatrix failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ExpandMatrix = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandMatrixTooLarge(t *testing.T) {
+	values := make([]string, maxBulkDocuments+1)
+	for i := range values {
+		values[i] = string(rune('a' + i%26))
+	}
+	if _, err := ExpandMatrix(map[string][]string{"field": values}); err == nil {
+		t.Errorf("ExpandMatrix accepted a matrix of %d documents", len(values))
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// A bulk edit sets one field to one value on every RUNTIME document of a type
+// that matches some field filters, e.g. status "retired" on all DS documents
+// of a model. The value is checked against each document's template. Apply
+// takes the CAS of every document from the preview, so a document that
+// changed since it was previewed is not touched.
+
+// BulkEditRequest selects documents and the change to make to them.
+type BulkEditRequest struct {
+	Type    string            `json:"type"`
+	Filters map[string]string `json:"filters"`
+	Field   string            `json:"field"`
+	Value   interface{}       `json:"value"`
+	// Documents are the previewed documents to change, with their CAS;
+	// only used when applying.
+	Documents []BulkEditTarget `json:"documents,omitempty"`
+}
+
+// BulkEditTarget is a previewed document.
+type BulkEditTarget struct {
+	ID  string `json:"id"`
+	CAS string `json:"cas"`
+}
+
+// BulkEditResult is the change to one document.
+type BulkEditResult struct {
+	ID     string      `json:"id"`
+	CAS    string      `json:"cas,omitempty"` // as a string, it does not fit a JavaScript number
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+	Status string      `json:"status"` // change, unchanged, invalid, then updated, conflict or failed
+	Error  string      `json:"error,omitempty"`
+
+	changes []StatusChange
+	checked []gocb.MutateInSpec // the fields a commit recomputes along
+	expiry  *time.Duration      // set when the edit changes the TTL tier
+}
+
+// isFieldName reports whether name can be used as a field in a query.
+func isFieldName(name string) bool {
+	return isCollectionName(name)
+}
+
+// SelectDocuments returns the RUNTIME documents of docType whose fields equal
+// the filter values, each with its CAS.
+func SelectDocuments(cluster *gocb.Cluster, docType string, filters map[string]string) ([]map[string]interface{}, []gocb.Cas, error) {
+	conditions := []string{"r.type = $type"}
+	params := map[string]interface{}{"type": docType}
+	keys := make([]string, 0, len(filters))
+	for key := range filters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		if !isFieldName(key) {
+			return nil, nil, fmt.Errorf("invalid filter field %q", key)
+		}
+		name := fmt.Sprintf("f%d", i)
+		conditions = append(conditions, fmt.Sprintf("r.%s = $%s", key, name))
+		params[name] = filters[key]
+	}
+	query := "SELECT meta(r).id AS id, meta(r).cas AS cas, r AS document FROM vxdata._default.RUNTIME r WHERE " +
+		strings.Join(conditions, " AND ") + " ORDER BY meta(r).id"
+	result, err := cluster.Query(query, &gocb.QueryOptions{NamedParameters: params})
+	if err != nil {
+		return nil, nil, err
+	}
+	var docs []map[string]interface{}
+	var cas []gocb.Cas
+	for result.Next() {
+		var row struct {
+			ID       string                 `json:"id"`
+			CAS      uint64                 `json:"cas"`
+			Document map[string]interface{} `json:"document"`
+		}
+		if err := result.Row(&row); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode a document: %w", err)
+		}
+		row.Document["docId"] = row.ID
+		docs = append(docs, row.Document)
+		cas = append(cas, gocb.Cas(row.CAS))
+	}
+	if err := result.Err(); err != nil {
+		return nil, nil, err
+	}
+	return docs, cas, nil
+}
+
+// coerceValue converts a value typed into a text box to the JSON type the
+// field expects.
+func coerceValue(value interface{}, want string) interface{} {
+	s, ok := value.(string)
+	if !ok {
+		return value
+	}
+	switch want {
+	case "number":
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	}
+	return value
+}
+
+// editValue checks that field of doc may be set to value under template t
+// and returns the value to store.
+func (t FormTemplate) editValue(doc map[string]interface{}, field string, value interface{}) (interface{}, error) {
+	_, plain := t.Template[field]
+	_, object := t.Template["@"+field]
+	if !plain && !object {
+		return nil, fmt.Errorf("%s is not a field of %s", field, t.TemplateName)
+	}
+	if field == "id" || field == "type" || t.Computed[field] != "" {
+		return nil, fmt.Errorf("%s cannot be bulk edited", field)
+	}
+	want := t.expectedType(field)
+	value = coerceValue(value, want)
+	if want != "" && jsonType(value) != want {
+		return nil, fmt.Errorf("%s must be a %s", field, want)
+	}
+	updated := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		updated[k] = v
+	}
+	updated[field] = value
+	if opts, ok := t.options(field, updated); ok {
+		values := []interface{}{value}
+		if list, ok := value.([]interface{}); ok {
+			values = list
+		}
+		for _, v := range values {
+			if !containsString(opts, fmt.Sprintf("%v", v)) {
+				return nil, fmt.Errorf("%v is not one of %s", v, strings.Join(opts, ", "))
+			}
+		}
+	}
+	return value, nil
+}
+
+// PreviewBulkEdit returns the change the request makes to each selected
+// document.
+func PreviewBulkEdit(req BulkEditRequest) ([]BulkEditResult, error) {
+	if req.Type == "" || req.Field == "" {
+		return nil, errors.New("a type and a field are required")
+	}
+	templates, err := GetFormTemplates()
+	if err != nil {
+		return nil, err
+	}
+	cluster := GetConnection(GetCBCredentials())
+	defer cluster.Close(nil)
+	docs, cas, err := SelectDocuments(cluster, req.Type, req.Filters)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]BulkEditResult, 0, len(docs))
+	for i, doc := range docs {
+		r := bulkEditDocument(cluster, templates, doc, req.Field, req.Value)
+		r.CAS = strconv.FormatUint(uint64(cas[i]), 10)
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// bulkEditDocument works out the change to one document, which is checked
+// as a commit would check it.
+func bulkEditDocument(cluster *gocb.Cluster, templates []FormTemplate, doc map[string]interface{}, field string, value interface{}) BulkEditResult {
+	id, _ := doc["docId"].(string)
+	r := BulkEditResult{ID: id, Before: doc[field], Status: "change"}
+	t, ok := templateForDocument(templates, doc)
+	if !ok {
+		r.Status, r.Error = "invalid", "no template found for this document"
+		return r
+	}
+	after, err := t.editValue(doc, field, value)
+	if err != nil {
+		r.Status, r.Error = "invalid", err.Error()
+		return r
+	}
+	r.After = after
+	if reflect.DeepEqual(r.Before, after) {
+		r.Status = "unchanged"
+		return r
+	}
+	updated := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		if k != "docId" {
+			updated[k] = v
+		}
+	}
+	updated[field] = after
+	checked, err := t.checkDocument(cluster, updated)
+	if err != nil {
+		r.Status, r.Error = "invalid", err.Error()
+		return r
+	}
+	if r.checked, err = checkedSpecs(updated, checked); err != nil {
+		r.Status, r.Error = "invalid", err.Error()
+		return r
+	}
+	if r.changes, err = t.StatusChanges(doc, checked, "bulk-edit"); err != nil {
+		r.Status, r.Error = "invalid", err.Error()
+		return r
+	}
+	if n := 1 + len(r.checked) + len(r.changes); n > maxPatchSpecs {
+		r.Status, r.Error = "invalid", fmt.Sprintf("the edit makes %d changes, at most %d are allowed", n, maxPatchSpecs)
+		return r
+	}
+	if t.tierChanged(doc, checked) {
+		expiry, _, err := t.DocumentExpiry(checked)
+		if err != nil {
+			r.Status, r.Error = "invalid", err.Error()
+			return r
+		}
+		r.expiry = &expiry
+	}
+	return r
+}
+
+// ApplyBulkEdit changes the previewed documents. Each is re-read and
+// re-checked, and only changed if its CAS is still the previewed one.
+func ApplyBulkEdit(req BulkEditRequest) ([]BulkEditResult, error) {
+	if req.Field == "" || !isFieldName(req.Field) {
+		return nil, fmt.Errorf("invalid field %q", req.Field)
+	}
+	templates, err := GetFormTemplates()
+	if err != nil {
+		return nil, err
+	}
+	cluster := GetConnection(GetCBCredentials())
+	defer cluster.Close(nil)
+	collection := cluster.Bucket(GetCBCredentials().CBBucket).Collection("RUNTIME")
+	results := make([]BulkEditResult, 0, len(req.Documents))
+	for _, target := range req.Documents {
+		r := BulkEditResult{ID: target.ID}
+		previewed, err := strconv.ParseUint(target.CAS, 10, 64)
+		if err != nil {
+			r.Status, r.Error = "failed", "invalid cas"
+			results = append(results, r)
+			continue
+		}
+		getResult, err := collection.Get(target.ID, &gocb.GetOptions{})
+		if err != nil {
+			r.Status, r.Error = "failed", err.Error()
+			results = append(results, r)
+			continue
+		}
+		if getResult.Cas() != gocb.Cas(previewed) {
+			r.Status, r.Error = "conflict", "changed since the preview"
+			results = append(results, r)
+			continue
+		}
+		var doc map[string]interface{}
+		if err := getResult.Content(&doc); err != nil {
+			r.Status, r.Error = "failed", err.Error()
+			results = append(results, r)
+			continue
+		}
+		doc["docId"] = target.ID
+		r = bulkEditDocument(cluster, templates, doc, req.Field, req.Value)
+		if r.Status != "change" {
+			results = append(results, r)
+			continue
+		}
+		specs := append([]gocb.MutateInSpec{gocb.UpsertSpec(req.Field, r.After, nil)}, r.checked...)
+		for _, ch := range r.changes {
+			specs = append(specs, gocb.ArrayAppendSpec("statusHistory", ch, &gocb.ArrayAppendSpecOptions{CreatePath: true}))
+		}
+		opts := &gocb.MutateInOptions{Cas: getResult.Cas(), PreserveExpiry: true}
+		if r.expiry != nil {
+			opts.Expiry, opts.PreserveExpiry = *r.expiry, false
+		}
+		_, err = collection.MutateIn(target.ID, specs, opts)
+		switch {
+		case errors.Is(err, gocb.ErrCasMismatch):
+			r.Status, r.Error = "conflict", "changed since the preview"
+		case err != nil:
+			r.Status, r.Error = "failed", err.Error()
+		default:
+			r.Status = "updated"
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+func bulkEditPreview(c *gin.Context) {
+	var req BulkEditRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.String(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	results, err := PreviewBulkEdit(req)
+	if err != nil {
+		c.String(http.StatusBadRequest, fmt.Sprintf("Error: %v", err))
+		return
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+func bulkEditApply(c *gin.Context) {
+	var req BulkEditRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.String(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	results, err := ApplyBulkEdit(req)
+	if err != nil {
+		c.String(http.StatusBadRequest, fmt.Sprintf("Error: %v", err))
+		return
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+func bulkEditPage(c *gin.Context) {
+	c.HTML(http.StatusOK, "bulk_edit.html", topNavData())
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// runCommand runs a command line subcommand and returns the process exit
+// code. Without a subcommand the web server is started instead.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "lint":
+		return runLint(args[1:])
+	case "migrate":
+		return runMigrate(args[1:])
+	case "drift":
+		return runDrift(args[1:])
+	case "graph":
+		return runGraph(args[1:])
+	case "export":
+		return runExport(args[1:])
+	case "import":
+		return runImport(args[1:])
+	case "reconcile":
+		return runReconcile(args[1:])
+	case "help", "-h", "--help":
+		printUsage()
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		printUsage()
+		return 2
+	}
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, `usage: vxFormsUI [command]
+
+With no command the web server is started on :8080.
+
+commands:
+  lint [-json]                         check the template documents in COMMON
+  migrate -template NAME [-apply]      preview (or apply) document migrations
+  drift [-template NAME] [-json]       compare stored documents with their templates
+  graph -root ID [-depth N] [-format F] print the document graph as dot, mermaid or json
+  export [-types T,...] [-format F] -o FILE
+                                       export RUNTIME documents as zip, tar or ndjson
+  import -file FILE [-policy P] [-dry-run]
+                                       import an export; P is skip, overwrite or fail
+  reconcile -dir DIR [-types T,...] [-apply] [-yes] [-json]
+                                       plan (and apply) making RUNTIME match a directory`)
+}
+
+func runLint(args []string) int {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the issues as JSON")
+	fs.Parse(args)
+
+	issues, err := LintStoredTemplates()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lint: %v\n", err)
+		return 1
+	}
+	if *asJSON {
+		out, _ := json.MarshalIndent(issues, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		for _, i := range issues {
+			field := ""
+			if i.Field != "" {
+				field = " " + i.Field
+			}
+			fmt.Printf("%s: %s (%s)%s: %s\n", i.Severity, i.Template, i.DocID, field, i.Message)
+		}
+		fmt.Printf("%d issue(s), %d error(s)\n", len(issues), lintErrorCount(issues))
+	}
+	if lintErrorCount(issues) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	name := fs.String("template", "", "templateName whose documents are migrated")
+	apply := fs.Bool("apply", false, "apply the migrations instead of previewing them")
+	fs.Parse(args)
+	if *name == "" {
+		fmt.Fprintln(os.Stderr, "migrate: -template is required")
+		return 2
+	}
+
+	t, err := FindFormTemplate(*name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	results, err := RunMigrations(t, *apply)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	failed := 0
+	for _, r := range results {
+		status := "pending"
+		switch {
+		case r.Error != "":
+			status = "failed: " + r.Error
+			failed++
+		case r.Applied:
+			status = "migrated"
+		}
+		fmt.Printf("%s (revision %d -> %d): %s\n", r.ID, r.FromRevision, t.Revision, status)
+		for _, ch := range r.Changes {
+			before, _ := json.Marshal(ch.Before)
+			after, _ := json.Marshal(ch.After)
+			fmt.Printf("    %s: %s -> %s\n", ch.Field, before, after)
+		}
+	}
+	fmt.Printf("%d document(s), %d failed\n", len(results), failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func runDrift(args []string) int {
+	fs := flag.NewFlagSet("drift", flag.ExitOnError)
+	name := fs.String("template", "", "only report the documents of this templateName")
+	asJSON := fs.Bool("json", false, "print the reports as JSON")
+	fs.Parse(args)
+
+	reports, err := DriftReports(*name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "drift: %v\n", err)
+		return 1
+	}
+	if *asJSON {
+		out, _ := json.MarshalIndent(reports, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		for _, r := range reports {
+			fmt.Printf("%s: %d of %d document(s) differ\n", r.Template, r.Drifted, r.Documents)
+			for _, i := range r.Issues {
+				fmt.Printf("    %s %s [%s]: %s\n", i.ID, i.Field, i.Kind, i.Message)
+			}
+			for _, id := range r.Ambiguous {
+				fmt.Printf("    %s: ambiguous, not checked\n", id)
+			}
+		}
+	}
+	for _, r := range reports {
+		if r.Drifted > 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+func runGraph(args []string) int {
+	fs := flag.NewFlagSet("graph", flag.ExitOnError)
+	root := fs.String("root", "", "id of the document the graph starts from")
+	depth := fs.Int("depth", defaultGraphDepth, "how many references to follow")
+	format := fs.String("format", "dot", "output format: dot, mermaid or json")
+	fs.Parse(args)
+	if *root == "" {
+		fmt.Fprintln(os.Stderr, "graph: -root is required")
+		return 2
+	}
+
+	g, err := BuildGraph(*root, *depth)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "graph: %v\n", err)
+		return 1
+	}
+	switch *format {
+	case "dot":
+		fmt.Print(g.DOT())
+	case "mermaid":
+		fmt.Print(g.Mermaid())
+	case "json":
+		out, _ := json.MarshalIndent(g, "", "  ")
+		fmt.Println(string(out))
+	default:
+		fmt.Fprintf(os.Stderr, "graph: unknown format %q\n", *format)
+		return 2
+	}
+	return 0
+}
+
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	types := fs.String("types", "DS,PS,IS,JOB", "comma separated document types")
+	format := fs.String("format", "zip", "archive format: zip, tar (gzipped) or ndjson")
+	out := fs.String("o", "", "file to write, - for stdout")
+	fs.Parse(args)
+	if *out == "" {
+		fmt.Fprintln(os.Stderr, "export: -o is required")
+		return 2
+	}
+
+	entries, err := ExportDocuments(parseTypes(*types))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return 1
+	}
+	w := os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "export: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := WriteArchive(w, *format, entries); err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "exported %d document(s)\n", len(entries))
+	return 0
+}
+
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	file := fs.String("file", "", "zip, tar, tar.gz or ndjson export to import")
+	policy := fs.String("policy", ConflictSkip, "what to do with existing documents: skip, overwrite or fail")
+	dryRun := fs.Bool("dry-run", false, "only report what would be imported")
+	fs.Parse(args)
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "import: -file is required")
+		return 2
+	}
+
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %v\n", err)
+		return 1
+	}
+	entries, err := ReadArchive(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %v\n", err)
+		return 1
+	}
+	results, err := ImportDocuments(entries, *policy, *dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %v\n", err)
+		return 1
+	}
+	for _, r := range results {
+		status := r.Action
+		if *dryRun {
+			status += " (dry run)"
+		}
+		if r.Error != "" {
+			status += ": " + r.Error
+		}
+		fmt.Printf("%s: %s\n", r.ID, status)
+		for _, issue := range r.Issues {
+			fmt.Printf("    %s\n", issue)
+		}
+		for _, warning := range r.Warnings {
+			fmt.Printf("    warning: %s\n", warning)
+		}
+	}
+	counts := importCounts(results)
+	actions := make([]string, 0, len(counts))
+	for action := range counts {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	for _, action := range actions {
+		fmt.Printf("%s: %d  ", action, counts[action])
+	}
+	fmt.Println()
+	if counts["invalid"]+counts["conflict"]+counts["failed"] > 0 {
+		return 1
+	}
+	return 0
+}
+
+func runReconcile(args []string) int {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	dir := fs.String("dir", "", "directory of <id>.json documents")
+	types := fs.String("types", "", "comma separated types to manage (default: the types in the directory)")
+	apply := fs.Bool("apply", false, "apply the plan")
+	yes := fs.Bool("yes", false, "apply without asking for confirmation")
+	asJSON := fs.Bool("json", false, "print the plan as JSON")
+	fs.Parse(args)
+	if *dir == "" {
+		fmt.Fprintln(os.Stderr, "reconcile: -dir is required")
+		return 2
+	}
+
+	entries, err := ReadDocumentDir(*dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reconcile: %v\n", err)
+		return 1
+	}
+	plan, err := PlanReconcile(entries, parseTypes(*types))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reconcile: %v\n", err)
+		return 1
+	}
+	printPlan(plan, *asJSON)
+	counts := plan.Counts()
+	if counts["invalid"] > 0 {
+		fmt.Fprintf(os.Stderr, "reconcile: %d invalid document(s), not applying\n", counts["invalid"])
+		return 1
+	}
+	if !*apply || !plan.Changed() {
+		return 0
+	}
+	if !*yes {
+		fmt.Fprintf(os.Stderr, "Apply %d create(s), %d update(s) and %d delete(s)? [y/N] ", counts["create"], counts["update"], counts["delete"])
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			fmt.Fprintln(os.Stderr, "not applied")
+			return 1
+		}
+	}
+	if err := ApplyReconcile(&plan); err != nil {
+		for _, a := range plan.Actions {
+			if a.Error != "" {
+				fmt.Fprintf(os.Stderr, "%s %s: %s\n", a.Action, a.ID, a.Error)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "reconcile: %v\n", err)
+		return 1
+	}
+	fmt.Println("applied")
+	return 0
+}
+
+func printPlan(plan ReconcilePlan, asJSON bool) {
+	if asJSON {
+		out, _ := json.MarshalIndent(plan, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+	symbols := map[string]string{"create": "+", "update": "~", "delete": "-", "unchanged": " ", "invalid": "!"}
+	for _, a := range plan.Actions {
+		if a.Action == "unchanged" {
+			continue
+		}
+		fmt.Printf("%s %s (%s)\n", symbols[a.Action], a.ID, a.Action)
+		for _, ch := range a.Changes {
+			before, _ := json.Marshal(ch.Before)
+			after, _ := json.Marshal(ch.After)
+			fmt.Printf("    %s: %s -> %s\n", ch.Field, before, after)
+		}
+		for _, issue := range a.Issues {
+			fmt.Printf("    %s\n", issue)
+		}
+		for _, warning := range a.Warnings {
+			fmt.Printf("    warning: %s\n", warning)
+		}
+	}
+	c := plan.Counts()
+	fmt.Printf("types %s: %d to create, %d to update, %d to delete, %d unchanged, %d invalid\n",
+		strings.Join(plan.Types, ","), c["create"], c["update"], c["delete"], c["unchanged"], c["invalid"])
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/couchbase/gocb/v2"
+)
+
+// PrepareDocument turns a document submitted from the form of t into the
+// document that is stored. The browser does all of this live as well, but
+// the result here is the authoritative one:
+//
+//   - epoch and duration fields become integer seconds
+//   - fields hidden by visibleWhen are dropped and dependent options checked
+//   - computed fields are recomputed and "*field" placeholders resolved
+//   - the template name and revision are recorded
+//   - reference fields must point at existing documents of the right type
+//     and status
+//   - status changes must follow the status lifecycle
+func (t FormTemplate) PrepareDocument(cluster *gocb.Cluster, data map[string]interface{}) (map[string]interface{}, error) {
+	resolved, err := t.buildDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.CheckReferences(cluster, resolved, nil); err != nil {
+		return nil, err
+	}
+	return t.ApplyLifecycle(cluster, resolved)
+}
+
+// buildDocument is PrepareDocument without the reference check, for callers
+// that check references against documents not yet written.
+func (t FormTemplate) buildDocument(data map[string]interface{}) (map[string]interface{}, error) {
+	resolved, err := t.resolveFields(data)
+	if err != nil {
+		return nil, err
+	}
+	// record where the document came from, for migrations
+	resolved["templateName"] = t.TemplateName
+	resolved["templateRevision"] = t.Revision
+	return resolved, nil
+}
+
+// checkDocument runs the checks of PrepareDocument on a stored document
+// changed in place by a patch or a bulk edit, and returns it as a commit
+// would store it. The template it was written with and its status history
+// are left as they are.
+func (t FormTemplate) checkDocument(cluster *gocb.Cluster, doc map[string]interface{}) (map[string]interface{}, error) {
+	checked, err := t.resolveFields(doc)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.CheckReferences(cluster, checked, nil); err != nil {
+		return nil, err
+	}
+	return checked, nil
+}
+
+// resolveFields converts, filters, computes and resolves the fields of a
+// document.
+func (t FormTemplate) resolveFields(data map[string]interface{}) (map[string]interface{}, error) {
+	data, err := t.ConvertKinds(data)
+	if err != nil {
+		return nil, err
+	}
+	data, err = t.ApplyConditions(data)
+	if err != nil {
+		return nil, err
+	}
+	computed, errs := t.ComputeFields(data)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("cannot compute %s", formatComputeErrors(errs))
+	}
+	for key, value := range computed {
+		data[key] = value
+	}
+	resolved, unresolved := t.ResolveDocument(data)
+	if len(unresolved) > 0 {
+		return nil, fmt.Errorf("unresolved placeholders %s", formatUnresolved(unresolved))
+	}
+	return resolved, nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// Compare shows the structural differences between any two documents, e.g.
+// an ingest document that works and one that does not. Objects are compared
+// key by key and arrays element by element, down to the leaves. String
+// values holding JSON, like an embedded template, are parsed and compared
+// the same way when both documents hold JSON there.
+
+// maxCompareDifferences bounds the differences reported for one comparison.
+const maxCompareDifferences = 1000
+
+// Difference is one difference between documents a and b, at a JSON Pointer.
+type Difference struct {
+	Path string      `json:"path"`
+	Kind string      `json:"kind"` // added (only in b), removed (only in a) or changed
+	A    interface{} `json:"a"`
+	B    interface{} `json:"b"`
+}
+
+// ComparedDocument is one side of a comparison.
+type ComparedDocument struct {
+	ID         string                 `json:"id"`
+	Collection string                 `json:"collection"`
+	Document   map[string]interface{} `json:"document"`
+}
+
+// Comparison is the result of comparing two documents.
+type Comparison struct {
+	A           ComparedDocument `json:"a"`
+	B           ComparedDocument `json:"b"`
+	Differences []Difference     `json:"differences"`
+	Truncated   bool             `json:"truncated,omitempty"`
+}
+
+// pointerToken escapes a key for use in a JSON Pointer.
+func pointerToken(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+// embeddedJSON returns the object or array a string value holds, if any.
+func embeddedJSON(v interface{}) (interface{}, bool) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, false
+	}
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "{") && !strings.HasPrefix(s, "[") {
+		return nil, false
+	}
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(s), &parsed); err != nil {
+		return nil, false
+	}
+	return parsed, true
+}
+
+// differ collects the differences of a comparison.
+type differ struct {
+	differences []Difference
+	truncated   bool
+}
+
+func (d *differ) add(diff Difference) {
+	if len(d.differences) >= maxCompareDifferences {
+		d.truncated = true
+		return
+	}
+	d.differences = append(d.differences, diff)
+}
+
+// compare records the differences between a and b below path. Strings
+// holding JSON are compared structurally only when both sides hold JSON, so
+// a string is never reported as equal to the object it spells out.
+func (d *differ) compare(path string, a, b interface{}) {
+	if reflect.DeepEqual(a, b) {
+		return
+	}
+	pa, okA := embeddedJSON(a)
+	pb, okB := embeddedJSON(b)
+	if okA && okB {
+		// the same JSON formatted differently still differs as a string
+		if !reflect.DeepEqual(pa, pb) && d.compareStructure(path, pa, pb) {
+			return
+		}
+	} else if d.compareStructure(path, a, b) {
+		return
+	}
+	d.add(Difference{Path: path, Kind: "changed", A: a, B: b})
+}
+
+// compareStructure compares two objects or two arrays member by member, and
+// reports whether a and b were such a pair.
+func (d *differ) compareStructure(path string, a, b interface{}) bool {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		if bv, ok := b.(map[string]interface{}); ok {
+			d.compareObjects(path, av, bv)
+			return true
+		}
+	case []interface{}:
+		if bv, ok := b.([]interface{}); ok {
+			for i := 0; i < len(av) || i < len(bv); i++ {
+				p := path + "/" + strconv.Itoa(i)
+				switch {
+				case i >= len(bv):
+					d.add(Difference{Path: p, Kind: "removed", A: av[i]})
+				case i >= len(av):
+					d.add(Difference{Path: p, Kind: "added", B: bv[i]})
+				default:
+					d.compare(p, av[i], bv[i])
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (d *differ) compareObjects(path string, a, b map[string]interface{}) {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p := path + "/" + pointerToken(k)
+		av, inA := a[k]
+		bv, inB := b[k]
+		switch {
+		case !inB:
+			d.add(Difference{Path: p, Kind: "removed", A: av})
+		case !inA:
+			d.add(Difference{Path: p, Kind: "added", B: bv})
+		default:
+			d.compare(p, av, bv)
+		}
+	}
+}
+
+// CompareValues returns the structural differences between a and b.
+func CompareValues(a, b map[string]interface{}) ([]Difference, bool) {
+	d := &differ{differences: []Difference{}}
+	d.compareObjects("", a, b)
+	return d.differences, d.truncated
+}
+
+// loadComparedDocument reads a document from RUNTIME or, failing that,
+// COMMON, so templates and their revisions can be compared as well.
+func loadComparedDocument(id string) (ComparedDocument, error) {
+	cluster := GetConnection(GetCBCredentials())
+	bucket := cluster.Bucket(GetCBCredentials().CBBucket)
+	for _, name := range []string{"RUNTIME", "COMMON"} {
+		getResult, err := bucket.Collection(name).Get(id, &gocb.GetOptions{})
+		if errors.Is(err, gocb.ErrDocumentNotFound) {
+			continue
+		}
+		if err != nil {
+			return ComparedDocument{}, fmt.Errorf("failed to retrieve %s: %w", id, err)
+		}
+		doc := ComparedDocument{ID: id, Collection: name}
+		if err := getResult.Content(&doc.Document); err != nil {
+			return ComparedDocument{}, fmt.Errorf("failed to decode %s: %w", id, err)
+		}
+		return doc, nil
+	}
+	return ComparedDocument{}, fmt.Errorf("%s: %w", id, gocb.ErrDocumentNotFound)
+}
+
+// CompareDocuments loads and compares the documents with ids a and b.
+func CompareDocuments(a, b string) (Comparison, error) {
+	var c Comparison
+	var err error
+	if c.A, err = loadComparedDocument(a); err != nil {
+		return c, err
+	}
+	if c.B, err = loadComparedDocument(b); err != nil {
+		return c, err
+	}
+	c.Differences, c.Truncated = CompareValues(c.A.Document, c.B.Document)
+	return c, nil
+}
+
+// compareHandler compares ?a=<id> and ?b=<id>. Browsers get the side by side
+// view, other clients the JSON diff; ?format=json or ?format=html chooses.
+func compareHandler(c *gin.Context) {
+	format := c.Query("format")
+	if format == "" {
+		format = "json"
+		if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML {
+			format = "html"
+		}
+	}
+	a, b := c.Query("a"), c.Query("b")
+	if format == "html" {
+		data := topNavData()
+		data["a"], data["b"] = a, b
+		if a != "" && b != "" {
+			comparison, err := CompareDocuments(a, b)
+			if err != nil {
+				data["error"] = err.Error()
+			} else {
+				data["comparison"] = comparison
+			}
+		}
+		c.HTML(http.StatusOK, "compare.html", data)
+		return
+	}
+	if a == "" || b == "" {
+		c.String(http.StatusBadRequest, "Missing a or b")
+		return
+	}
+	comparison, err := CompareDocuments(a, b)
+	switch {
+	case errors.Is(err, gocb.ErrDocumentNotFound):
+		c.String(http.StatusNotFound, fmt.Sprintf("Not found: %v", err))
+	case err != nil:
+		c.String(http.StatusInternalServerError, "Failed to compare documents")
+	default:
+		c.JSON(http.StatusOK, comparison)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCompareValues(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []Difference
+	}{
+		{
+			name: "identical",
+			a:    `{"type":"DS","models":["HRRR"]}`,
+			b:    `{"type":"DS","models":["HRRR"]}`,
+			want: []Difference{},
+		},
+		{
+			name: "added, removed and changed",
+			a:    `{"type":"DS","status":"active","region":"CONUS"}`,
+			b:    `{"type":"DS","status":"retired","subset":"METAR"}`,
+			want: []Difference{
+				{Path: "/region", Kind: "removed", A: "CONUS"},
+				{Path: "/status", Kind: "changed", A: "active", B: "retired"},
+				{Path: "/subset", Kind: "added", B: "METAR"},
+			},
+		},
+		{
+			name: "nested objects and arrays",
+			a:    `{"ingest":{"models":["HRRR","RAP"],"fcstLen":18}}`,
+			b:    `{"ingest":{"models":["HRRR","GFS","NAM"],"fcstLen":18}}`,
+			want: []Difference{
+				{Path: "/ingest/models/1", Kind: "changed", A: "RAP", B: "GFS"},
+				{Path: "/ingest/models/2", Kind: "added", B: "NAM"},
+			},
+		},
+		{
+			name: "keys are escaped",
+			a:    `{"a/b":1,"c~d":1}`,
+			b:    `{"a/b":2,"c~d":2}`,
+			want: []Difference{
+				{Path: "/a~1b", Kind: "changed", A: float64(1), B: float64(2)},
+				{Path: "/c~0d", Kind: "changed", A: float64(1), B: float64(2)},
+			},
+		},
+		{
+			name: "JSON strings on both sides",
+			a:    `{"template":"{\"status\":\"active\",\"fcstLen\":18}"}`,
+			b:    `{"template":"{\"status\":\"retired\",\"fcstLen\":18}"}`,
+			want: []Difference{
+				{Path: "/template/status", Kind: "changed", A: "active", B: "retired"},
+			},
+		},
+		{
+			name: "JSON string against an object",
+			a:    `{"template":"{\"status\":\"active\"}"}`,
+			b:    `{"template":{"status":"active"}}`,
+			want: []Difference{
+				{Path: "/template", Kind: "changed", A: `{"status":"active"}`, B: map[string]interface{}{"status": "active"}},
+			},
+		},
+		{
+			name: "JSON strings formatted differently",
+			a:    `{"template":"{\"status\":\"active\"}"}`,
+			b:    `{"template":"{ \"status\": \"active\" }"}`,
+			want: []Difference{
+				{Path: "/template", Kind: "changed", A: `{"status":"active"}`, B: `{ "status": "active" }`},
+			},
+		},
+		{
+			name: "JSON object string against a JSON array string",
+			a:    `{"template":"{\"status\":\"active\"}"}`,
+			b:    `{"template":"[\"active\"]"}`,
+			want: []Difference{
+				{Path: "/template", Kind: "changed", A: `{"status":"active"}`, B: `["active"]`},
+			},
+		},
+		{
+			name: "object against an array",
+			a:    `{"models":{"HRRR":true}}`,
+			b:    `{"models":["HRRR"]}`,
+			want: []Difference{
+				{Path: "/models", Kind: "changed", A: map[string]interface{}{"HRRR": true}, B: []interface{}{"HRRR"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var a, b map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.a), &a); err != nil {
+				t.Fatalf("invalid test JSON a: %v", err)
+			}
+			if err := json.Unmarshal([]byte(tt.b), &b); err != nil {
+				t.Fatalf("invalid test JSON b: %v", err)
+			}
+			got, truncated := CompareValues(a, b)
+			if truncated {
+				t.Errorf("CompareValues truncated the differences")
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CompareValues = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareValuesTruncated(t *testing.T) {
+	a := make(map[string]interface{})
+	for i := 0; i < maxCompareDifferences+10; i++ {
+		a[fmt.Sprintf("field%d", i)] = i
+	}
+	got, truncated := CompareValues(a, map[string]interface{}{})
+	if !truncated || len(got) != maxCompareDifferences {
+		t.Errorf("got %d differences, truncated %v; want %d, truncated", len(got), truncated, maxCompareDifferences)
+	}
+}
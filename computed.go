@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/expr-lang/expr"
+)
+
+// Computed fields are template values starting with '=', e.g.
+//
+//	"ttl": "=ttlTierSeconds[ttlTier]"
+//	"endEpoch": "=startEpoch + duration"
+//
+// The expression is evaluated with github.com/expr-lang/expr, which has no
+// access to the host beyond the environment given to it: the other field
+// values plus the lookup tables from lookupTables.
+
+// maxExpressionNodes bounds the size of a computed field expression.
+const maxExpressionNodes = 1000
+
+// lookupTables returns the metadata tables that computed field expressions
+// may use. A table that cannot be loaded is left out and logged.
+func lookupTables() map[string]interface{} {
+	tables := make(map[string]interface{})
+	seconds, err := tierSeconds()
+	if err != nil {
+		log.Printf("Error getting TTL tiers: %v", err)
+		return tables
+	}
+	tables["ttlTierSeconds"] = seconds
+	return tables
+}
+
+// expressionValue converts a submitted form value into the type an expression
+// expects: the strings of numeric fields (field kinds and fields with a
+// number default) become numbers. Everything else is passed through, so
+// codes such as "01" stay strings.
+func (t FormTemplate) expressionValue(key string, v interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok || t.expectedType(key) != "number" {
+		return v
+	}
+	if i, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return f
+	}
+	return s
+}
+
+// EvaluateExpression evaluates a single computed field expression against env.
+func EvaluateExpression(source string, env map[string]interface{}) (interface{}, error) {
+	program, err := expr.Compile(source, expr.Env(env), expr.AllowUndefinedVariables(), expr.MaxNodes(maxExpressionNodes))
+	if err != nil {
+		return nil, err
+	}
+	return expr.Run(program, env)
+}
+
+// ComputeFields evaluates the computed fields of t from the submitted values.
+// Computed fields may refer to each other; evaluation repeats until the values
+// settle, at most once per computed field. It returns the computed values and
+// an error message for every field that could not be computed.
+func (t FormTemplate) ComputeFields(values map[string]interface{}) (map[string]interface{}, map[string]string) {
+	computed := make(map[string]interface{}, len(t.Computed))
+	errs := make(map[string]string)
+	if len(t.Computed) == 0 {
+		return computed, errs
+	}
+	env := lookupTables()
+	for k, v := range values {
+		env[k] = t.expressionValue(k, v)
+	}
+	keys := make([]string, 0, len(t.Computed))
+	for key := range t.Computed {
+		keys = append(keys, key)
+		delete(env, key)
+	}
+	sort.Strings(keys)
+	for pass := 0; pass < len(keys); pass++ {
+		changed := false
+		errs = make(map[string]string)
+		for _, key := range keys {
+			result, err := EvaluateExpression(t.Computed[key], env)
+			if err == nil && result == nil {
+				err = fmt.Errorf("no value")
+			}
+			if err != nil {
+				errs[key] = err.Error()
+				continue
+			}
+			if previous, ok := env[key]; !ok || fmt.Sprintf("%v", previous) != fmt.Sprintf("%v", result) {
+				changed = true
+			}
+			env[key] = result
+			computed[key] = result
+		}
+		if !changed {
+			break
+		}
+	}
+	return computed, errs
+}
+
+// formatComputeErrors renders computed field errors for error messages.
+func formatComputeErrors(errs map[string]string) string {
+	keys := make([]string, 0, len(errs))
+	for key := range errs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s: %s", key, errs[key]))
+	}
+	return strings.Join(parts, "; ")
+}
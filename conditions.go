@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A template document may carry, next to its "template" object:
+//
+//	"visibleWhen": {"subDocType": "type == 'DS'"}
+//	"dependentOptions": {
+//	    "subDocType": {
+//	        "dependsOn": "subType",
+//	        "options": {"CTC": "&getCTCSubDocTypes", "SUMS": ["SURFACE"], "default": []}
+//	    }
+//	}
+//
+// visibleWhen conditions are expr expressions over the field values, like
+// computed fields. dependentOptions lists, for each value of the field it
+// depends on, either a "&function" or the literal options; "default" is used
+// for values that are not listed.
+
+// DependentOptions are the options of a field that depend on another field.
+type DependentOptions struct {
+	DependsOn string
+	Options   map[string]interface{}
+}
+
+// parseVisibleWhen reads the "visibleWhen" object of a template document.
+func parseVisibleWhen(common map[string]interface{}) map[string]string {
+	conditions := make(map[string]string)
+	raw, ok := common["visibleWhen"].(map[string]interface{})
+	if !ok {
+		return conditions
+	}
+	for key, v := range raw {
+		if condition, ok := v.(string); ok {
+			conditions[key] = condition
+		}
+	}
+	return conditions
+}
+
+// parseDependentOptions reads the "dependentOptions" object of a template
+// document.
+func parseDependentOptions(common map[string]interface{}) map[string]DependentOptions {
+	dependent := make(map[string]DependentOptions)
+	raw, ok := common["dependentOptions"].(map[string]interface{})
+	if !ok {
+		return dependent
+	}
+	for key, v := range raw {
+		spec, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		dependsOn, _ := spec["dependsOn"].(string)
+		options, _ := spec["options"].(map[string]interface{})
+		if dependsOn == "" || options == nil {
+			continue
+		}
+		dependent[key] = DependentOptions{DependsOn: dependsOn, Options: options}
+	}
+	return dependent
+}
+
+// VisibleFields evaluates the visibleWhen conditions of t. A field without a
+// condition is always visible; a condition that fails to evaluate hides the
+// field and is returned with an error message.
+func (t FormTemplate) VisibleFields(values map[string]interface{}) (map[string]bool, map[string]string) {
+	visible := make(map[string]bool, len(t.Conditions))
+	errs := make(map[string]string)
+	if len(t.Conditions) == 0 {
+		return visible, errs
+	}
+	env := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		env[k] = t.expressionValue(k, v)
+	}
+	for key, condition := range t.Conditions {
+		result, err := EvaluateExpression(condition, env)
+		if err != nil {
+			errs[key] = err.Error()
+		}
+		show, _ := result.(bool)
+		visible[key] = err == nil && show
+	}
+	return visible, errs
+}
+
+// Lookup returns the options of a dependent field for the current value of
+// the field it depends on.
+func (d DependentOptions) Lookup(values map[string]interface{}) ([]string, error) {
+	driver := fmt.Sprintf("%v", values[d.DependsOn])
+	if list, ok := values[d.DependsOn].([]interface{}); ok && len(list) == 1 {
+		driver = fmt.Sprintf("%v", list[0])
+	}
+	spec, ok := d.Options[driver]
+	if !ok {
+		spec = d.Options["default"]
+	}
+	switch val := spec.(type) {
+	case string:
+		return CallNamedFunction(val)
+	case []interface{}:
+		opts := make([]string, 0, len(val))
+		for _, v := range val {
+			opts = append(opts, fmt.Sprintf("%v", v))
+		}
+		return opts, nil
+	case nil:
+		return []string{}, nil
+	default:
+		return nil, fmt.Errorf("invalid options for %s=%s", d.DependsOn, driver)
+	}
+}
+
+// DependentFieldOptions returns the current options of every dependent field
+// of t, and an error message for each field whose options could not be found.
+func (t FormTemplate) DependentFieldOptions(values map[string]interface{}) (map[string][]string, map[string]string) {
+	options := make(map[string][]string, len(t.DependentOptions))
+	errs := make(map[string]string)
+	for key, d := range t.DependentOptions {
+		opts, err := d.Lookup(values)
+		if err != nil {
+			errs[key] = err.Error()
+			continue
+		}
+		options[key] = opts
+	}
+	return options, errs
+}
+
+// ApplyConditions removes the fields hidden by visibleWhen from a submitted
+// document and checks every visible dependent field against its options. A
+// condition that fails to evaluate is reported rather than taken as hidden,
+// so the field is never dropped by mistake.
+func (t FormTemplate) ApplyConditions(doc map[string]interface{}) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		out[k] = v
+	}
+	var problems []string
+	visible, errs := t.VisibleFields(doc)
+	for key, show := range visible {
+		if msg, failed := errs[key]; failed {
+			problems = append(problems, fmt.Sprintf("%s: cannot evaluate visibleWhen: %s", key, msg))
+			continue
+		}
+		if !show {
+			delete(out, strings.TrimPrefix(key, "@"))
+		}
+	}
+	for key, d := range t.DependentOptions {
+		value, ok := out[key]
+		if !ok || value == nil || value == "" {
+			continue
+		}
+		opts, err := d.Lookup(out)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", key, err))
+			continue
+		}
+		allowed := make(map[string]bool, len(opts))
+		for _, o := range opts {
+			allowed[o] = true
+		}
+		chosen := []interface{}{value}
+		if list, ok := value.([]interface{}); ok {
+			chosen = list
+		}
+		for _, c := range chosen {
+			if !allowed[fmt.Sprintf("%v", c)] {
+				problems = append(problems, fmt.Sprintf("%s: %v is not a valid option when %s is %v", key, c, d.DependsOn, out[d.DependsOn]))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return out, nil
+}
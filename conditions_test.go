@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyConditions(t *testing.T) {
+	tmpl := FormTemplate{Conditions: map[string]string{
+		"expires": `ttlTier != ""`,
+		"@ingest": `subset == "METAR"`,
+	}}
+	tests := []struct {
+		name  string
+		doc   string
+		want  string
+		fails string
+	}{
+		{name: "visible", doc: `{"ttlTier":"short","expires":3600,"subset":"METAR","ingest":{}}`, want: `{"ttlTier":"short","expires":3600,"subset":"METAR","ingest":{}}`},
+		{name: "hidden", doc: `{"ttlTier":"","expires":3600,"subset":"RAOB","ingest":{}}`, want: `{"ttlTier":"","subset":"RAOB"}`},
+		{name: "a condition that cannot be evaluated", doc: `{"ttlTier":"short","expires":3600,"subset":["METAR"]}`, fails: "@ingest: cannot evaluate visibleWhen"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tmpl.ApplyConditions(decodeJSON(t, tt.doc))
+			if tt.fails != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.fails) {
+					t.Fatalf("ApplyConditions failed with %v, want %q", err, tt.fails)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyConditions failed: %v", err)
+			}
+			if want := decodeJSON(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
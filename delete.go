@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// Soft deleted documents are moved to the TRASH collection (which must exist
+// next to RUNTIME), wrapped with their id and the time they were deleted, and
+// can be restored from there. Each delete is kept under its own key, so a
+// document deleted, recreated and deleted again has two trash entries.
+
+// TrashEntry is a soft deleted document.
+type TrashEntry struct {
+	ID        string                 `json:"id"`
+	Document  map[string]interface{} `json:"document"`
+	DeletedAt int64                  `json:"deletedAt"`
+}
+
+// trashKey returns the TRASH key of id deleted at the given time.
+func trashKey(id string, at time.Time) string {
+	return fmt.Sprintf("%s@%d", id, at.UnixNano())
+}
+
+func trashCollection() *gocb.Collection {
+	cluster := GetConnection(GetCBCredentials())
+	return cluster.Bucket(GetCBCredentials().CBBucket).Collection("TRASH")
+}
+
+// FindReferences returns the ids of the RUNTIME documents that mention id
+// anywhere in their content, e.g. a PS listing a DS id or a JOB naming a PS.
+func FindReferences(id string) ([]string, error) {
+	return findReferences(GetConnection(GetCBCredentials()), id)
+}
+
+// findReferences is FindReferences over an open connection.
+func findReferences(cluster *gocb.Cluster, id string) ([]string, error) {
+	query := "SELECT RAW meta(r).id FROM vxdata._default.RUNTIME r WHERE meta(r).id != $id AND ANY v WITHIN r SATISFIES v = $id END ORDER BY meta(r).id"
+	result, err := cluster.Query(query, &gocb.QueryOptions{NamedParameters: map[string]interface{}{"id": id}})
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for result.Next() {
+		var ref string
+		if err := result.Row(&ref); err == nil {
+			ids = append(ids, ref)
+		}
+	}
+	return ids, nil
+}
+
+// DeleteFormData removes a document from RUNTIME. A soft delete keeps it in
+// TRASH first, so it can be restored.
+func DeleteFormData(id string, soft bool) error {
+	collection := runtimeCollection()
+	if soft {
+		getResult, err := collection.Get(id, &gocb.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to retrieve data: %w", err)
+		}
+		var doc map[string]interface{}
+		if err := getResult.Content(&doc); err != nil {
+			return fmt.Errorf("failed to decode content: %w", err)
+		}
+		now := time.Now()
+		key := trashKey(id, now)
+		trash := trashCollection()
+		entry := TrashEntry{ID: id, Document: doc, DeletedAt: now.Unix()}
+		if _, err := trash.Insert(key, entry, &gocb.InsertOptions{}); err != nil {
+			return fmt.Errorf("failed to move to trash: %w", err)
+		}
+		// only remove the version that was copied to the trash
+		_, err = collection.Remove(id, &gocb.RemoveOptions{Cas: getResult.Cas()})
+		if err != nil {
+			if _, rerr := trash.Remove(key, &gocb.RemoveOptions{}); rerr != nil {
+				log.Printf("Error removing trash entry %s of a failed delete: %v", key, rerr)
+			}
+			return fmt.Errorf("failed to delete data: %w", err)
+		}
+		return nil
+	}
+	if _, err := collection.Remove(id, &gocb.RemoveOptions{}); err != nil {
+		return fmt.Errorf("failed to delete data: %w", err)
+	}
+	return nil
+}
+
+// latestTrashKey returns the TRASH key of the most recently deleted copy of
+// id.
+func latestTrashKey(id string) (string, error) {
+	cluster := GetConnection(GetCBCredentials())
+	// entries from before the keys carried the time are stored under the id
+	query := "SELECT RAW meta(t).id FROM vxdata._default.TRASH t WHERE IFMISSING(t.id, meta(t).id) = $id ORDER BY t.deletedAt DESC LIMIT 1"
+	result, err := cluster.Query(query, &gocb.QueryOptions{NamedParameters: map[string]interface{}{"id": id}})
+	if err != nil {
+		return "", err
+	}
+	var key string
+	if err := result.One(&key); err != nil {
+		return "", fmt.Errorf("%s is not in the trash: %w", id, gocb.ErrDocumentNotFound)
+	}
+	return key, nil
+}
+
+// RestoreFormData moves the soft deleted document under the TRASH key back
+// to RUNTIME. It fails if a document with the same id has been created
+// since.
+func RestoreFormData(key string) (string, error) {
+	trash := trashCollection()
+	getResult, err := trash.Get(key, &gocb.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve from trash: %w", err)
+	}
+	var entry TrashEntry
+	if err := getResult.Content(&entry); err != nil {
+		return "", fmt.Errorf("failed to decode content: %w", err)
+	}
+	id := entry.ID
+	if id == "" {
+		id = key
+	}
+	templates, err := GetFormTemplates()
+	if err != nil {
+		return id, fmt.Errorf("failed to load templates: %w", err)
+	}
+	// a restored document starts a new lifetime of its TTL tier
+	expiry, err := expiryFor(templates, entry.Document)
+	if err != nil {
+		return id, fmt.Errorf("failed to restore data: %w", err)
+	}
+	if _, err := runtimeCollection().Insert(id, entry.Document, &gocb.InsertOptions{Expiry: expiry}); err != nil {
+		return id, fmt.Errorf("failed to restore data: %w", err)
+	}
+	if _, err := trash.Remove(key, &gocb.RemoveOptions{}); err != nil {
+		return id, fmt.Errorf("restored, but failed to remove from trash: %w", err)
+	}
+	return id, nil
+}
+
+// ListTrash returns the soft deleted documents, most recently deleted first.
+func ListTrash() ([]map[string]interface{}, error) {
+	cluster := GetConnection(GetCBCredentials())
+	query := "SELECT meta(t).id AS `key`, IFMISSING(t.id, meta(t).id) AS id, t.deletedAt, t.document.type AS type FROM vxdata._default.TRASH t ORDER BY t.deletedAt DESC"
+	result, err := cluster.Query(query, &gocb.QueryOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var entries []map[string]interface{}
+	for result.Next() {
+		var row map[string]interface{}
+		if err := result.Row(&row); err == nil {
+			entries = append(entries, row)
+		}
+	}
+	return entries, nil
+}
+
+// deleteHandler deletes ?id=<id> permanently with ?mode=hard, or moves it to
+// the trash with ?mode=soft; the mode must be given. When other documents
+// reference it, the delete is refused with 409 and the list of references
+// unless ?force=true is given.
+func deleteHandler(c *gin.Context) {
+	id := c.Query("id")
+	if id == "" {
+		c.String(http.StatusBadRequest, "Missing id")
+		return
+	}
+	mode := c.Query("mode")
+	if mode != "soft" && mode != "hard" {
+		c.String(http.StatusBadRequest, "The mode must be soft or hard")
+		return
+	}
+	soft := mode == "soft"
+	refs, err := FindReferences(id)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to check references")
+		return
+	}
+	if len(refs) > 0 && c.Query("force") != "true" {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":      fmt.Sprintf("%s is referenced by %s", id, strings.Join(refs, ", ")),
+			"references": refs,
+		})
+		return
+	}
+	if err := DeleteFormData(id, soft); err != nil {
+		c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to delete: %v", err))
+		return
+	}
+	verb := "Deleted"
+	if soft {
+		verb = "Moved to trash"
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("%s: %s", verb, id), "references": refs})
+}
+
+func trashPage(c *gin.Context) {
+	entries, err := ListTrash()
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to list trash")
+		return
+	}
+	data := topNavData()
+	data["entries"] = entries
+	c.HTML(http.StatusOK, "trash.html", data)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// deriveFunctions are the "&functions" offered when deriving a template, in
+// the order they are tried. Scalar lookups are matched against string values,
+// id lookups against lists of ids.
+var (
+	deriveScalarFunctions = []string{
+		"getStatuses", "getDataSourceStatuses", "getProcessSpecStatuses",
+		"getDataSourceTypes", "getDataSourceSubTypes", "getSubTypes", "getSubDocTypes",
+		"getRegions", "getSubsets", "getTTLTier",
+	}
+	deriveIDFunctions = []string{"getDataSourceId", "getProcessSpecIds", "getIngestDocumentIds"}
+)
+
+// plausible epoch range for suggesting the epoch field kind (2001 - 2096)
+const (
+	minDerivedEpoch = 1000000000
+	maxDerivedEpoch = 4000000000
+)
+
+// derivedLookups caches the lookup values used while deriving one template.
+type derivedLookups map[string]map[string]bool
+
+func (l derivedLookups) values(name string) map[string]bool {
+	if v, ok := l[name]; ok {
+		return v
+	}
+	set := make(map[string]bool)
+	if values, err := CallNamedFunction(name); err == nil {
+		for _, v := range values {
+			set[v] = true
+		}
+	}
+	l[name] = set
+	return set
+}
+
+// matchScalar returns the first lookup function whose values contain s.
+func (l derivedLookups) matchScalar(s string) string {
+	for _, name := range deriveScalarFunctions {
+		if l.values(name)[s] {
+			return name
+		}
+	}
+	return ""
+}
+
+// matchIDs returns the id lookup function that contains every id in list.
+func (l derivedLookups) matchIDs(list []interface{}) string {
+	if len(list) == 0 {
+		return ""
+	}
+	for _, name := range deriveIDFunctions {
+		ids := l.values(name)
+		all := true
+		for _, v := range list {
+			if s, ok := v.(string); !ok || !ids[s] {
+				all = false
+				break
+			}
+		}
+		if all {
+			return name
+		}
+	}
+	return ""
+}
+
+// deriveIDPattern turns a document id into a pattern by replacing each
+// ":"-separated segment that equals the value of another string field with a
+// placeholder for that field.
+func deriveIDPattern(id string, doc map[string]interface{}) string {
+	byValue := make(map[string]string)
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if s, ok := doc[key].(string); ok && key != "id" && !bookkeepingFields[key] && s != "" {
+			if _, taken := byValue[s]; !taken {
+				byValue[s] = key
+			}
+		}
+	}
+	segments := strings.Split(id, ":")
+	for i, segment := range segments {
+		if key, ok := byValue[segment]; ok {
+			segments[i] = "*" + key
+		}
+	}
+	return strings.Join(segments, ":")
+}
+
+// DeriveTemplate infers a template document from an example document: field
+// kinds from the JSON types, "@" for nested objects, "&functions" for values
+// found in the known lookups, and an id pattern from the id structure. The
+// bookkeeping fields are left out. The result is a suggestion to be reviewed
+// in the template editor.
+func DeriveTemplate(doc map[string]interface{}) (map[string]interface{}, string) {
+	lookups := make(derivedLookups)
+	template := make(map[string]interface{}, len(doc))
+	fieldKinds := make(map[string]interface{})
+	for key, value := range doc {
+		if bookkeepingFields[key] {
+			continue
+		}
+		switch val := value.(type) {
+		case map[string]interface{}:
+			template["@"+key] = val
+		case []interface{}:
+			if fn := lookups.matchIDs(val); fn != "" {
+				template[key] = "&" + fn
+				continue
+			}
+			nested := false
+			for _, v := range val {
+				if _, ok := v.(map[string]interface{}); ok {
+					nested = true
+					break
+				}
+			}
+			if nested {
+				template["@"+key] = val
+			} else {
+				template[key] = val
+			}
+		case string:
+			switch {
+			case key == "id":
+				template[key] = deriveIDPattern(val, doc)
+			case key == "type" || key == "docType":
+				template[key] = "#" + val
+			default:
+				if fn := lookups.matchScalar(val); fn != "" {
+					template[key] = "&" + fn
+				} else {
+					template[key] = val
+				}
+			}
+		case float64:
+			if val == float64(int64(val)) && val >= minDerivedEpoch && val <= maxDerivedEpoch {
+				fieldKinds[key] = KindEpoch
+				template[key] = 0
+			} else {
+				template[key] = val
+			}
+		default:
+			template[key] = val
+		}
+	}
+	name := "DERIVED"
+	if t, ok := doc["type"].(string); ok && t != "" {
+		name = t
+		if dt, ok := doc["docType"].(string); ok && dt != "" {
+			name = t + "_" + dt
+		}
+	}
+	derived := map[string]interface{}{
+		"templateName": name,
+		"template":     template,
+	}
+	if len(fieldKinds) > 0 {
+		derived["fieldKinds"] = fieldKinds
+	}
+	docID := fmt.Sprintf("MD:V01:%s:TEMPLATE", strings.ToUpper(name))
+	return derived, docID
+}
+
+// adminTemplateDerivePage opens the template editor on a template derived from
+// the RUNTIME document ?id=<docId>.
+func adminTemplateDerivePage(c *gin.Context) {
+	id := c.Query("id")
+	if id == "" {
+		c.String(http.StatusBadRequest, "Missing id")
+		return
+	}
+	doc, err := RetrieveFormData(id)
+	if err != nil {
+		c.String(http.StatusNotFound, "Not found")
+		return
+	}
+	derived, docID := DeriveTemplate(doc)
+	data := topNavData()
+	data["docId"] = docID
+	data["newDocument"] = true
+	data["derivedFrom"] = id
+	data["revision"] = 0
+	data["document"] = derived
+	c.HTML(http.StatusOK, "template_edit.html", data)
+}
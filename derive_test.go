@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeriveTemplateSkipsBookkeeping(t *testing.T) {
+	doc := decodeJSON(t, `{
+		"id": "DS:HRRR:V01",
+		"type": "DS",
+		"fcstLen": 18,
+		"docId": "DS:HRRR:V01",
+		"templateName": "HRRR",
+		"templateRevision": 3,
+		"statusHistory": [{"field": "status", "to": "active", "at": 1700000000}]
+	}`)
+	derived, docID := DeriveTemplate(doc)
+	want := map[string]interface{}{
+		"id":      "*type:HRRR:V01", // not *templateName
+		"type":    "#DS",
+		"fcstLen": float64(18),
+	}
+	if got := derived["template"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("derived template is %v, want %v", got, want)
+	}
+	if docID != "MD:V01:DS:TEMPLATE" {
+		t.Errorf("derived template id is %s, want MD:V01:DS:TEMPLATE", docID)
+	}
+}
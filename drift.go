@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DriftIssue is one way a stored document differs from its template.
+type DriftIssue struct {
+	ID      string `json:"id"`
+	Field   string `json:"field"`
+	Kind    string `json:"kind"` // missing, unexpected, type, enum or constant
+	Message string `json:"message"`
+}
+
+// DriftReport is the drift of every document created from one template.
+type DriftReport struct {
+	Template  string       `json:"template"`
+	Documents int          `json:"documents"`
+	Drifted   int          `json:"drifted"`
+	Issues    []DriftIssue `json:"issues"`
+	// Ambiguous are the documents without a templateName whose type other
+	// templates create as well, so they are not checked against this one.
+	Ambiguous []string `json:"ambiguous,omitempty"`
+}
+
+// bookkeepingFields are document fields that are not part of any template.
+var bookkeepingFields = map[string]bool{
+	"docId":            true,
+	"templateName":     true,
+	"templateRevision": true,
+	"statusHistory":    true,
+}
+
+// jsonType names the JSON type of a decoded value.
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case float64, int, int64:
+		return "number"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}, []string:
+		return "array"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// expectedType returns the JSON type a document field should have, from the
+// template value of the field, or "" when any type is accepted.
+func (t FormTemplate) expectedType(key string) string {
+	if _, ok := t.Kinds[key]; ok {
+		return "number"
+	}
+	if _, ok := t.Computed[key]; ok {
+		return ""
+	}
+	if _, ok := t.Template["@"+key]; ok {
+		return ""
+	}
+	raw, ok := t.Template[key]
+	if !ok {
+		return ""
+	}
+	if s, ok := raw.(string); ok && strings.HasPrefix(s, "&") {
+		// id lookups fill multi-selects, the others single selects
+		if fn, ok := namedFunctions[strings.TrimPrefix(s, "&")]; ok && fn.multiple {
+			return "array"
+		}
+		return "string"
+	}
+	if _, ok := raw.([]interface{}); ok {
+		// a list of options; a single choice is stored as a string
+		return ""
+	}
+	return jsonType(raw)
+}
+
+// options returns the allowed values of an enum field of doc, if it has any.
+func (t FormTemplate) options(key string, doc map[string]interface{}) ([]string, bool) {
+	if d, ok := t.DependentOptions[key]; ok {
+		opts, err := d.Lookup(doc)
+		return opts, err == nil
+	}
+	if fn, ok := t.Functions[key]; ok {
+		opts, err := CallNamedFunction(fn)
+		return opts, err == nil
+	}
+	if list, ok := t.Template[key].([]interface{}); ok {
+		opts := make([]string, 0, len(list))
+		for _, v := range list {
+			opts = append(opts, fmt.Sprintf("%v", v))
+		}
+		return opts, true
+	}
+	return nil, false
+}
+
+// CheckDrift compares one stored document with the field model of t.
+func (t FormTemplate) CheckDrift(doc map[string]interface{}) []DriftIssue {
+	id, _ := doc["docId"].(string)
+	if id == "" {
+		id, _ = doc["id"].(string)
+	}
+	var issues []DriftIssue
+	add := func(field, kind, format string, args ...interface{}) {
+		issues = append(issues, DriftIssue{ID: id, Field: field, Kind: kind, Message: fmt.Sprintf(format, args...)})
+	}
+	visible, _ := t.VisibleFields(doc)
+	expected := make(map[string]bool, len(t.Template))
+	for key := range t.Template {
+		field := strings.TrimPrefix(key, "@")
+		expected[field] = true
+		if show, ok := visible[key]; ok && !show {
+			continue
+		}
+		value, present := doc[field]
+		if !present {
+			add(field, "missing", "missing field")
+			continue
+		}
+		if want := t.expectedType(field); want != "" && jsonType(value) != want {
+			add(field, "type", "is %s, expected %s", jsonType(value), want)
+			continue
+		}
+		if t.DisabledFields[key] && t.Patterns[field] == nil && t.Computed[key] == "" {
+			if constant, ok := t.Fields[key].(string); ok && fmt.Sprintf("%v", value) != constant {
+				add(field, "constant", "is %v, expected the constant %s", value, constant)
+			}
+			continue
+		}
+		if opts, ok := t.options(field, doc); ok {
+			allowed := make(map[string]bool, len(opts))
+			for _, o := range opts {
+				allowed[o] = true
+			}
+			values := []interface{}{value}
+			if list, ok := value.([]interface{}); ok {
+				values = list
+			}
+			for _, v := range values {
+				if !allowed[fmt.Sprintf("%v", v)] {
+					add(field, "enum", "%v is not one of the allowed values", v)
+				}
+			}
+		}
+	}
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !expected[key] && !bookkeepingFields[key] {
+			add(key, "unexpected", "field is not in the template")
+		}
+	}
+	return issues
+}
+
+// TemplateDrift reports the drift of every document created from t.
+// templates are all the templates, to attribute the legacy documents.
+func TemplateDrift(t FormTemplate, templates []FormTemplate) (DriftReport, error) {
+	docs, ambiguous, err := TemplateDocuments(t, templates)
+	if err != nil {
+		return DriftReport{}, err
+	}
+	report := DriftReport{Template: t.TemplateName, Documents: len(docs), Ambiguous: ambiguous}
+	for _, doc := range docs {
+		issues := t.CheckDrift(doc)
+		if len(issues) > 0 {
+			report.Drifted++
+			report.Issues = append(report.Issues, issues...)
+		}
+	}
+	return report, nil
+}
+
+// DriftReports reports the drift of the documents of every template, or of
+// the named template only.
+func DriftReports(name string) ([]DriftReport, error) {
+	templates, err := GetFormTemplates()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].TemplateName < templates[j].TemplateName })
+	var reports []DriftReport
+	for _, t := range templates {
+		if name != "" && t.TemplateName != name {
+			continue
+		}
+		report, err := TemplateDrift(t, templates)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// adminDriftPage shows the drift report, for ?template=<name> or for all
+// templates.
+func adminDriftPage(c *gin.Context) {
+	reports, err := DriftReports(c.Query("template"))
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Error loading documents")
+		return
+	}
+	if c.Query("format") == "json" {
+		c.JSON(http.StatusOK, reports)
+		return
+	}
+	data := topNavData()
+	data["reports"] = reports
+	c.HTML(http.StatusOK, "drift.html", data)
+}
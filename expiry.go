@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// A template can bind a TTL tier field to the expiry of its documents:
+//
+//	"expiryTier": "ttlTier"
+//
+// Storing a document then sets its Couchbase expiry to the TierSeconds of
+// the chosen tier (MD:V01:TTLTiers), counted from the write. A tier of 0
+// seconds, or no tier, means the document does not expire. Commits, bulk
+// edits and patches of a stored document that do not change the tier field
+// keep its current expiry. Batch commits, bulk generation, imports and
+// reconciles set it from the tier on every write.
+
+// defaultExpiringWithin is how far ahead the expiring view looks.
+const defaultExpiringWithin = 7 * 24 * time.Hour
+
+// maxExpiringDocuments bounds the expiring view.
+const maxExpiringDocuments = 500
+
+// ExpiringDocument is a document of the expiring view.
+type ExpiringDocument struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	ExpiresAt int64  `json:"expiresAt"`
+	Remaining int64  `json:"remaining"` // seconds
+}
+
+// parseExpiryTier reads the "expiryTier" field name of a template document.
+func parseExpiryTier(common map[string]interface{}) string {
+	field, _ := common["expiryTier"].(string)
+	return field
+}
+
+// tierSeconds returns the seconds of each TTL tier.
+func tierSeconds() (map[string]int, error) {
+	tiers, err := GetTTLTier()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get TTL tiers: %w", err)
+	}
+	seconds, err := GetTTLTierSeconds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get TTL tier seconds: %w", err)
+	}
+	result := make(map[string]int, len(tiers))
+	for i, tier := range tiers {
+		if i >= len(seconds) {
+			break
+		}
+		if s, err := strconv.Atoi(seconds[i]); err == nil {
+			result[tier] = s
+		}
+	}
+	return result, nil
+}
+
+// DocumentExpiry returns the expiry of doc under t, and whether t binds
+// expiry to a tier field at all.
+func (t FormTemplate) DocumentExpiry(doc map[string]interface{}) (time.Duration, bool, error) {
+	if t.ExpiryTier == "" {
+		return 0, false, nil
+	}
+	value, ok := doc[t.ExpiryTier]
+	if !ok || value == nil || value == "" {
+		return 0, true, nil
+	}
+	tier := fmt.Sprintf("%v", value)
+	seconds, err := tierSeconds()
+	if err != nil {
+		return 0, true, err
+	}
+	s, ok := seconds[tier]
+	if !ok {
+		return 0, true, fmt.Errorf("%s: unknown TTL tier %q", t.ExpiryTier, tier)
+	}
+	return time.Duration(s) * time.Second, true, nil
+}
+
+// expiryFor returns the expiry of doc under its template.
+func expiryFor(templates []FormTemplate, doc map[string]interface{}) (time.Duration, error) {
+	t, ok := templateForDocument(templates, doc)
+	if !ok {
+		return 0, nil
+	}
+	expiry, _, err := t.DocumentExpiry(doc)
+	return expiry, err
+}
+
+// commitExpiry returns the expiry a commit of doc under t sets, and whether
+// the stored document keeps its current expiry instead, which it does unless
+// the commit changes its tier.
+func (t FormTemplate) commitExpiry(cluster *gocb.Cluster, doc map[string]interface{}) (time.Duration, bool, error) {
+	expiry, _, err := t.DocumentExpiry(doc)
+	if err != nil {
+		return 0, false, err
+	}
+	id, _ := doc["id"].(string)
+	stored, err := storedDocument(cluster, id)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to load the stored document: %w", err)
+	}
+	return expiry, stored != nil && !t.tierChanged(stored, doc), nil
+}
+
+// tierChanged reports whether a change from before to after touches the tier
+// field of t, so the expiry has to be set again.
+func (t FormTemplate) tierChanged(before, after map[string]interface{}) bool {
+	return t.ExpiryTier != "" && !reflect.DeepEqual(before[t.ExpiryTier], after[t.ExpiryTier])
+}
+
+// ListExpiring returns the RUNTIME documents that expire within the given
+// time (any time, when 0), soonest first, optionally of one type only.
+func ListExpiring(within time.Duration, docType string) ([]ExpiringDocument, error) {
+	now := time.Now()
+	conditions := "meta(r).expiration > 0"
+	params := map[string]interface{}{"limit": maxExpiringDocuments}
+	if within > 0 {
+		conditions += " AND meta(r).expiration <= $until"
+		params["until"] = now.Add(within).Unix()
+	}
+	if docType != "" {
+		conditions += " AND r.type = $type"
+		params["type"] = docType
+	}
+	cluster := GetConnection(GetCBCredentials())
+	query := "SELECT meta(r).id AS id, r.type AS type, meta(r).expiration AS expiresAt FROM vxdata._default.RUNTIME r WHERE " +
+		conditions + " ORDER BY meta(r).expiration, meta(r).id LIMIT $limit"
+	result, err := cluster.Query(query, &gocb.QueryOptions{NamedParameters: params})
+	if err != nil {
+		return nil, err
+	}
+	var docs []ExpiringDocument
+	for result.Next() {
+		var doc ExpiringDocument
+		if err := result.Row(&doc); err == nil {
+			doc.Remaining = doc.ExpiresAt - now.Unix()
+			docs = append(docs, doc)
+		}
+	}
+	return docs, nil
+}
+
+// ExtendExpiry pushes the expiry of a RUNTIME document back by the given
+// time or, when by is 0, renews it to the full lifetime of its TTL tier. It
+// returns the new expiry.
+func ExtendExpiry(id string, by time.Duration) (time.Time, error) {
+	collection := runtimeCollection()
+	getResult, err := collection.Get(id, &gocb.GetOptions{WithExpiry: true})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to retrieve data: %w", err)
+	}
+	now := time.Now()
+	var expiry time.Duration
+	if by > 0 {
+		from := getResult.ExpiryTime()
+		if from.IsZero() {
+			return time.Time{}, errors.New("the document does not expire")
+		}
+		if from.Before(now) {
+			from = now
+		}
+		expiry = from.Add(by).Sub(now)
+	} else {
+		var doc map[string]interface{}
+		if err := getResult.Content(&doc); err != nil {
+			return time.Time{}, fmt.Errorf("failed to decode content: %w", err)
+		}
+		templates, err := GetFormTemplates()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if expiry, err = expiryFor(templates, doc); err != nil {
+			return time.Time{}, err
+		}
+		if expiry == 0 {
+			return time.Time{}, errors.New("the document has no TTL tier to renew from")
+		}
+	}
+	if _, err := collection.Touch(id, expiry, &gocb.TouchOptions{}); err != nil {
+		return time.Time{}, fmt.Errorf("failed to extend expiry: %w", err)
+	}
+	return now.Add(expiry), nil
+}
+
+// expiringPage lists the documents expiring within ?within= (a duration such
+// as 7d; 0 for all) of ?type=.
+func expiringPage(c *gin.Context) {
+	within := defaultExpiringWithin
+	if w := c.Query("within"); w != "" {
+		seconds, err := ParseDuration(w)
+		if err != nil {
+			c.String(http.StatusBadRequest, fmt.Sprintf("Invalid within: %v", err))
+			return
+		}
+		within = time.Duration(seconds) * time.Second
+	}
+	docs, err := ListExpiring(within, c.Query("type"))
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to list expiring documents")
+		return
+	}
+	data := topNavData()
+	data["documents"] = docs
+	data["within"] = FormatDuration(int64(within / time.Second))
+	data["type"] = c.Query("type")
+	c.HTML(http.StatusOK, "expiring.html", data)
+}
+
+// extendHandler extends the expiry of ?id= by ?by= (a duration), or renews
+// it from its TTL tier.
+func extendHandler(c *gin.Context) {
+	id := c.Query("id")
+	if id == "" {
+		c.String(http.StatusBadRequest, "Missing id")
+		return
+	}
+	var by time.Duration
+	if b := c.Query("by"); b != "" {
+		seconds, err := ParseDuration(b)
+		if err != nil || seconds <= 0 {
+			c.String(http.StatusBadRequest, "Invalid by")
+			return
+		}
+		by = time.Duration(seconds) * time.Second
+	}
+	expiresAt, err := ExtendExpiry(id, by)
+	switch {
+	case errors.Is(err, gocb.ErrDocumentNotFound):
+		c.String(http.StatusNotFound, "Not found")
+	case err != nil:
+		c.String(http.StatusBadRequest, fmt.Sprintf("Error: %v", err))
+	default:
+		c.JSON(http.StatusOK, gin.H{"id": id, "expiresAt": expiresAt.Unix(), "remaining": int64(time.Until(expiresAt) / time.Second)})
+	}
+}
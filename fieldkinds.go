@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Field kinds are declared in a template document next to its "template"
+// object:
+//
+//	"fieldKinds": {"startEpoch": "epoch", "ttl": "duration"}
+//
+// An epoch field is rendered as a UTC date-time picker and stored as integer
+// seconds since 1970. A duration field is entered as text such as "6h", "30d"
+// or "1d12h" and stored as integer seconds.
+const (
+	KindEpoch    = "epoch"
+	KindDuration = "duration"
+)
+
+// epochInputLayout is the value format of an <input type="datetime-local">.
+const epochInputLayout = "2006-01-02T15:04:05"
+
+var epochLayouts = []string{
+	time.RFC3339,
+	epochInputLayout,
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// parseFieldKinds reads the "fieldKinds" object of a template document.
+func parseFieldKinds(common map[string]interface{}) map[string]string {
+	kinds := make(map[string]string)
+	raw, ok := common["fieldKinds"].(map[string]interface{})
+	if !ok {
+		return kinds
+	}
+	for key, v := range raw {
+		if kind, ok := v.(string); ok {
+			kinds[key] = kind
+		}
+	}
+	return kinds
+}
+
+// ParseEpoch converts a submitted epoch value (seconds, or a UTC date-time
+// string) to integer seconds.
+func ParseEpoch(v interface{}) (int64, error) {
+	switch val := v.(type) {
+	case float64:
+		return int64(val), nil
+	case int:
+		return int64(val), nil
+	case int64:
+		return val, nil
+	case string:
+		s := strings.TrimSpace(val)
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n, nil
+		}
+		for _, layout := range epochLayouts {
+			if tm, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+				return tm.Unix(), nil
+			}
+		}
+		return 0, fmt.Errorf("invalid date-time %q", val)
+	default:
+		return 0, fmt.Errorf("invalid epoch %v", v)
+	}
+}
+
+// FormatEpoch renders epoch seconds for a datetime-local input, in UTC.
+func FormatEpoch(v interface{}) string {
+	seconds, err := ParseEpoch(v)
+	if err != nil {
+		return ""
+	}
+	return time.Unix(seconds, 0).UTC().Format(epochInputLayout)
+}
+
+var durationUnits = map[byte]int64{
+	's': 1,
+	'm': 60,
+	'h': 60 * 60,
+	'd': 24 * 60 * 60,
+	'w': 7 * 24 * 60 * 60,
+}
+
+// ParseDuration converts a submitted duration ("90", "6h", "30d", "1d12h")
+// to integer seconds. A bare number is taken as seconds.
+func ParseDuration(v interface{}) (int64, error) {
+	switch val := v.(type) {
+	case float64:
+		return int64(val), nil
+	case int:
+		return int64(val), nil
+	case int64:
+		return val, nil
+	case string:
+		s := strings.ToLower(strings.TrimSpace(val))
+		if s == "" {
+			return 0, fmt.Errorf("empty duration")
+		}
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n, nil
+		}
+		var total int64
+		for s != "" {
+			i := 0
+			for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+				i++
+			}
+			if i == 0 || i == len(s) {
+				return 0, fmt.Errorf("invalid duration %q", val)
+			}
+			n, err := strconv.ParseInt(s[:i], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", val)
+			}
+			unit, ok := durationUnits[s[i]]
+			if !ok {
+				return 0, fmt.Errorf("invalid duration unit %q in %q", s[i], val)
+			}
+			total += n * unit
+			s = s[i+1:]
+		}
+		return total, nil
+	default:
+		return 0, fmt.Errorf("invalid duration %v", v)
+	}
+}
+
+// FormatDuration renders seconds as a human duration such as "1d12h".
+func FormatDuration(v interface{}) string {
+	seconds, err := ParseDuration(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	if seconds == 0 {
+		return "0s"
+	}
+	var b strings.Builder
+	if seconds < 0 {
+		b.WriteString("-")
+		seconds = -seconds
+	}
+	for _, unit := range []byte{'d', 'h', 'm', 's'} {
+		size := durationUnits[unit]
+		if seconds >= size {
+			fmt.Fprintf(&b, "%d%c", seconds/size, unit)
+			seconds %= size
+		}
+	}
+	return b.String()
+}
+
+// defaultKindValue returns the initial form value of a field of the given
+// kind. An epoch without a usable template value defaults to now.
+func defaultKindValue(kind string, v interface{}) interface{} {
+	switch kind {
+	case KindEpoch:
+		seconds, err := ParseEpoch(v)
+		if err != nil || seconds == 0 {
+			seconds = time.Now().Unix()
+		}
+		return seconds
+	case KindDuration:
+		seconds, err := ParseDuration(v)
+		if err != nil {
+			return v
+		}
+		return seconds
+	}
+	return v
+}
+
+// ConvertKinds converts the epoch and duration fields of a submitted document
+// to integer seconds. Empty values are left alone.
+func (t FormTemplate) ConvertKinds(doc map[string]interface{}) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		out[k] = v
+	}
+	var problems []string
+	for key, kind := range t.Kinds {
+		v, ok := out[key]
+		if !ok || v == nil || v == "" {
+			continue
+		}
+		var seconds int64
+		var err error
+		switch kind {
+		case KindEpoch:
+			seconds, err = ParseEpoch(v)
+		case KindDuration:
+			seconds, err = ParseDuration(v)
+		default:
+			continue
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", key, err))
+			continue
+		}
+		out[key] = seconds
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return out, fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return out, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in      interface{}
+		want    int64
+		wantErr bool
+	}{
+		{in: 3600, want: 3600},
+		{in: int64(90), want: 90},
+		{in: float64(120), want: 120},
+		{in: "45", want: 45},
+		{in: " 45 ", want: 45},
+		{in: "90s", want: 90},
+		{in: "15m", want: 900},
+		{in: "2h", want: 7200},
+		{in: "1d", want: 86400},
+		{in: "1w", want: 604800},
+		{in: "1d12h", want: 129600},
+		{in: "1H30M", want: 5400},
+		{in: "", wantErr: true},
+		{in: "h", wantErr: true},
+		{in: "10", want: 10},
+		{in: "10x", wantErr: true},
+		{in: "1h30", wantErr: true},
+		{in: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDuration(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseDuration(%#v) = %d, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseDuration(%#v) failed: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseDuration(%#v) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
@@ -13,11 +13,23 @@ import (
 )
 
 type FormTemplate struct {
-	TemplateName   string
-	Fields         map[string]interface{}
-	SelectFields   map[string][]string
-	SelectMode     string
-	DisabledFields map[string]bool
+	TemplateName     string
+	Fields           map[string]interface{}
+	SelectFields     map[string][]string
+	SelectMode       string
+	DisabledFields   map[string]bool
+	Patterns         map[string]interface{}
+	Computed         map[string]string
+	Conditions       map[string]string
+	DependentOptions map[string]DependentOptions
+	Kinds            map[string]string
+	Revision         int
+	Migrations       []Migration
+	Template         map[string]interface{} // the merged "template" object
+	Functions        map[string]string      // field -> "&function" name
+	References       map[string]ReferenceSpec
+	ExpiryTier       string            // the TTL tier field that sets the document expiry
+	Typeahead        map[string]string // field -> id lookup fetched as the user types
 }
 
 type Credentials struct {
@@ -110,137 +122,207 @@ func GetConnection(credentials Credentials) *gocb.Cluster {
 	return cluster
 }
 
-func UpsertFormData(id string, data map[string]interface{}) error {
+// runtimeCollection returns the RUNTIME collection, where the documents
+// created from the forms are kept.
+func runtimeCollection() *gocb.Collection {
+	cluster := GetConnection(GetCBCredentials())
+	return cluster.Bucket(GetCBCredentials().CBBucket).Collection("RUNTIME")
+}
+
+// UpsertFormData stores a document in RUNTIME. An expiry of 0 means it does
+// not expire; with preserveExpiry an existing document keeps its expiry
+// instead.
+func UpsertFormData(id string, data map[string]interface{}, expiry time.Duration, preserveExpiry bool) error {
 	cluster := GetConnection(GetCBCredentials())
 	bucket := cluster.Bucket(GetCBCredentials().CBBucket)
 	collection := bucket.Collection("RUNTIME") // Always put this kind of metadata into the RUNTIME collection
 
+	opts := &gocb.UpsertOptions{Expiry: expiry}
+	if preserveExpiry {
+		opts = &gocb.UpsertOptions{PreserveExpiry: true}
+	}
 	// Upsert the native map, not a JSON string
-	_, err := collection.Upsert(id, data, &gocb.UpsertOptions{})
+	_, err := collection.Upsert(id, data, opts)
 	if err != nil {
 		return fmt.Errorf("failed to upsert data: %w", err)
 	}
 	return nil
 }
 
+// InsertFormData stores a new document in RUNTIME. Unlike UpsertFormData it
+// fails with gocb.ErrDocumentExists rather than overwrite an existing one.
+func InsertFormData(id string, data map[string]interface{}, expiry time.Duration) error {
+	if _, err := runtimeCollection().Insert(id, data, &gocb.InsertOptions{Expiry: expiry}); err != nil {
+		return fmt.Errorf("failed to insert data: %w", err)
+	}
+	return nil
+}
 
 func GetFormTemplates() ([]FormTemplate, error) {
-	cluster := GetConnection(GetCBCredentials())
-	query := "SELECT * FROM vxdata._default.COMMON WHERE meta().id like '%TEMPLATE'"
-	result, err := cluster.Query(query, &gocb.QueryOptions{})
+	docs, err := GetTemplateDocuments()
 	if err != nil {
 		return nil, err
 	}
 	var templates []FormTemplate
-	for result.Next() {
-		var t FormTemplate
-		var row map[string]interface{}
-		if err := result.Row(&row); err != nil {
+	for _, common := range docs {
+		if abstract, _ := common["abstract"].(bool); abstract {
+			// base templates are only there to be extended
 			continue
 		}
-		common, ok := row["COMMON"].(map[string]interface{})
-		if !ok {
+		t, err := BuildFormTemplate(common)
+		if err != nil {
+			log.Printf("Error building form template: %v", err)
 			continue
 		}
-		t.TemplateName, _ = common["templateName"].(string)
-		fields := make(map[string]interface{}, 0)
-		disabledFields := make(map[string]bool, 0)
-		selectFields := make(map[string][]string, 0)
-		template := common["template"].(map[string]interface{})
-		var selectMode string = "multiple"
-		for key := range template {
-			disabledFields[key] = false
-			if _, ok := template[key].(string); ok {
-				vStr := template[key].(string)
-				if strings.HasPrefix(vStr, "&") {
-					selectMode = handleNamedFunction(vStr, selectMode, fields, key)
-				} else {
-					selectMode = handleFieldStr(vStr, fields, key)
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// BuildFormTemplate builds the form model of a single (already merged)
+// template document.
+func BuildFormTemplate(common map[string]interface{}) (FormTemplate, error) {
+	var t FormTemplate
+	t.TemplateName, _ = common["templateName"].(string)
+	t.Revision = templateRevision(common)
+	t.Migrations = parseMigrations(common)
+	fields := make(map[string]interface{}, 0)
+	disabledFields := make(map[string]bool, 0)
+	selectFields := make(map[string][]string, 0)
+	computed := make(map[string]string, 0)
+	template, ok := common["template"].(map[string]interface{})
+	if !ok {
+		return t, fmt.Errorf("template %s has no \"template\" object", t.TemplateName)
+	}
+	t.Template = template
+	t.Patterns = templatePatterns(template)
+	t.Kinds = parseFieldKinds(common)
+	t.Functions = make(map[string]string)
+	t.Typeahead = make(map[string]string)
+	var selectMode string = "multiple"
+	for key := range template {
+		disabledFields[key] = false
+		if _, ok := template[key].(string); ok {
+			vStr := template[key].(string)
+			if strings.HasPrefix(vStr, "&") {
+				t.Functions[key] = strings.TrimPrefix(vStr, "&")
+				if isTypeahead(t.Functions[key]) {
+					t.Typeahead[key] = t.Functions[key]
 				}
+				selectMode = handleNamedFunction(vStr, selectMode, fields, key)
+			} else if strings.HasPrefix(vStr, "=") {
+				// A computed field, evaluated from the other fields
+				computed[key] = strings.TrimPrefix(vStr, "=")
+				fields[key] = ""
+				disabledFields[key] = true
+				continue
 			} else {
-				if strings.HasPrefix(key, "@") {
-					// If the key is indicating a json, we handle it differently
-					// store it as a JSON value
-					jsonValue, err := json.MarshalIndent(template[key], "", "  ")
-					if err != nil {
-						log.Printf("Error marshalling template field %s: %v", key, err)
-						fields[key] = fmt.Sprintf("Error: %v", err)
-					} else {
-						fields[key] = string(jsonValue)
-					}
+				selectMode = handleFieldStr(vStr, fields, key)
+			}
+		} else {
+			if strings.HasPrefix(key, "@") {
+				// If the key is indicating a json, we handle it differently
+				// store it as a JSON value
+				jsonValue, err := json.MarshalIndent(template[key], "", "  ")
+				if err != nil {
+					log.Printf("Error marshalling template field %s: %v", key, err)
+					fields[key] = fmt.Sprintf("Error: %v", err)
 				} else {
-					if strings.Contains(key, "Epoch") {
-						template[key] = time.Now().Unix()
-					}
-					fields[key] = template[key]
+					fields[key] = string(jsonValue)
 				}
+			} else {
+				fields[key] = template[key]
 			}
-			var val interface{}
-			val = fields[key]
-			// test if val starts with a # - if so treat it as a constant
-			if strVal, ok := val.(string); ok && strings.HasPrefix(strVal, "#") {
-				// If it starts with a #, treat it as a constant
-				constantValue := strings.TrimPrefix(strVal, "#")
-				fields[key] = constantValue
-				disabledFields[key] = true // Mark this field as disabled
-				continue
+		}
+		var val interface{}
+		val = fields[key]
+		// test if val starts with a # - if so treat it as a constant
+		if strVal, ok := val.(string); ok && strings.HasPrefix(strVal, "#") {
+			// If it starts with a #, treat it as a constant
+			constantValue := strings.TrimPrefix(strVal, "#")
+			fields[key] = constantValue
+			disabledFields[key] = true // Mark this field as disabled
+			if kind, ok := t.Kinds[key]; ok {
+				fields[key] = defaultKindValue(kind, constantValue)
 			}
-			// Otherwise, handle the value based on its type
-
-			switch val := val.(type) {
-			case int:
-				fields[key] = val
-			case float64:
-				if strings.Contains(key, "Epoch") || strings.Contains(key, "duration") {
-					// If the key contains "Epoch" or "duration", convert it to an integer
-					fields[key] = int(val)
-				} else {
-					fields[key] = fmt.Sprintf("%f", val)
-				}
-			case bool:
-				fields[key] = val
-			case []string:
-				selectFields[key] = val
-				fields[key] = val
-			case []int:
-				selectFields[key] = make([]string, len(val))
-				for i, v := range val {
-					selectFields[key][i] = fmt.Sprintf("%d", v)
-				}
-				fields[key] = val
-			case []float64:
-				selectFields[key] = make([]string, len(val))
-				if strings.Contains(key, "Epoch") || strings.Contains(key, "duration") {
-					// If the key contains "Epoch", convert float64 to int
-					intSlice := make([]int, len(val))
-					for i, v := range val {
-						intSlice[i] = int(v)
-					}
-					fields[key] = intSlice
-				} else {
-					fields[key] = val
-				}
-			case string:
-				fields[key] = val
-			case []interface{}:
-				valSlice := val
-				opts := make([]string, 0, len(valSlice))
-				for _, v := range valSlice {
-					opts = append(opts, fmt.Sprintf("%v", v))
-				}
-				selectFields[key] = opts
-				fields[key] = ""
-			default:
-				fields[key] = fmt.Sprintf("%v", val)
+			continue
+		}
+		if kind, ok := t.Kinds[key]; ok {
+			// epoch and duration fields are held as integer seconds
+			fields[key] = defaultKindValue(kind, fields[key])
+			continue
+		}
+		// Otherwise, handle the value based on its type
+
+		switch val := val.(type) {
+		case int:
+			fields[key] = val
+		case float64:
+			if val == float64(int64(val)) {
+				// whole JSON numbers are integers
+				fields[key] = int64(val)
+			} else {
+				fields[key] = fmt.Sprintf("%f", val)
+			}
+		case bool:
+			fields[key] = val
+		case []string:
+			selectFields[key] = val
+			fields[key] = val
+		case []int:
+			selectFields[key] = make([]string, len(val))
+			for i, v := range val {
+				selectFields[key][i] = fmt.Sprintf("%d", v)
+			}
+			fields[key] = val
+		case []float64:
+			selectFields[key] = make([]string, len(val))
+			fields[key] = val
+		case string:
+			fields[key] = val
+		case []interface{}:
+			valSlice := val
+			opts := make([]string, 0, len(valSlice))
+			for _, v := range valSlice {
+				opts = append(opts, fmt.Sprintf("%v", v))
 			}
+			selectFields[key] = opts
+			fields[key] = ""
+		default:
+			fields[key] = fmt.Sprintf("%v", val)
 		}
-		t.Fields = fields
-		t.SelectMode = selectMode
-		t.SelectFields = selectFields
-		t.DisabledFields = disabledFields
-		templates = append(templates, t)
 	}
-	return templates, nil
+	t.Fields = fields
+	t.SelectMode = selectMode
+	t.SelectFields = selectFields
+	t.DisabledFields = disabledFields
+	t.Computed = computed
+	t.References = parseReferences(common, t.Functions)
+	t.ExpiryTier = parseExpiryTier(common)
+	t.Conditions = parseVisibleWhen(common)
+	t.DependentOptions = parseDependentOptions(common)
+	for key := range t.DependentOptions {
+		// dependent fields are always rendered as a select; the options
+		// are filled in from /lookup
+		if _, ok := selectFields[key]; !ok {
+			selectFields[key] = []string{""}
+		}
+	}
+	return t, nil
+}
+
+// FindFormTemplate returns the form template with the given templateName.
+func FindFormTemplate(name string) (FormTemplate, error) {
+	templates, err := GetFormTemplates()
+	if err != nil {
+		return FormTemplate{}, err
+	}
+	for _, t := range templates {
+		if t.TemplateName == name {
+			return t, nil
+		}
+	}
+	return FormTemplate{}, fmt.Errorf("template %s not found", name)
 }
 
 func handleFieldStr(vStr string, fields map[string]interface{}, key string) string {
@@ -248,140 +330,68 @@ func handleFieldStr(vStr string, fields map[string]interface{}, key string) stri
 	return ""
 }
 
+// namedFunction describes a "&name" lookup that a template field can use to
+// populate its options.
+type namedFunction struct {
+	lookup      func() ([]string, error)
+	description string // used in log and error messages
+	multiple    bool   // the select keeps the form's "multiple" mode
+	errorField  bool   // on failure, show the error in the field
+}
+
+var namedFunctions = map[string]namedFunction{
+	"getSubTypes":            {lookup: GetSubTypes, description: "sub types"},
+	"getDataSourceTypes":     {lookup: GetDataSourceTypes, description: "data source types"},
+	"getSubDocTypes":         {lookup: GetSubDocTypes, description: "sub document types"},
+	"getDataSourceId":        {lookup: GetDataSourceIds, description: "data source IDs", multiple: true},
+	"getProcessSpecIds":      {lookup: GetProcessSpecIds, description: "process spec IDs", multiple: true},
+	"getIngestDocumentIds":   {lookup: GetIngestDocumentIds, description: "ingest document IDs", multiple: true},
+	"getSubsets":             {lookup: GetSubsets, description: "subsets", errorField: true},
+	"getRegions":             {lookup: GetRegions, description: "regions", errorField: true},
+	"getCTCSubDocTypes":      {lookup: GetCTCSubDocTypes, description: "CTC sub document types", errorField: true},
+	"getSUMSSubDocTypes":     {lookup: GetSUMSSubDocTypes, description: "SUMS sub document types", errorField: true},
+	"getTTLTier":             {lookup: GetTTLTier, description: "TTL tier", errorField: true},
+	"getDataSourceSubTypes":  {lookup: GetDataSourceSubTypes, description: "data source sub types", errorField: true},
+	"getDataSourceStatuses":  {lookup: GetDataSourceStatuses, description: "data source statuses", errorField: true},
+	"getStatuses":            {lookup: GetStatuses, description: "statuses", errorField: true},
+	"getProcessSpecStatuses": {lookup: GetProcessSpecStatuses, description: "process spec statuses", errorField: true},
+}
+
+// CallNamedFunction runs the lookup for a "&name" (or bare name) function.
+func CallNamedFunction(name string) ([]string, error) {
+	fn, ok := namedFunctions[strings.TrimPrefix(name, "&")]
+	if !ok {
+		return nil, fmt.Errorf("unknown function: %s", name)
+	}
+	return fn.lookup()
+}
+
 func handleNamedFunction(vStr string, selectMode string, fields map[string]interface{}, key string) string {
 	funcName := strings.TrimPrefix(vStr, "&")
-	switch funcName {
-	case "getSubTypes":
-		selectMode = ""
-		subTypes, err := GetSubTypes()
-		if err != nil {
-			log.Printf("Error getting sub types: %v", err)
-		} else {
-			fields[key] = subTypes
-		}
-	case "getDataSourceTypes":
-		selectMode = ""
-		dataSourceTypes, err := GetDataSourceTypes()
-		if err != nil {
-			log.Printf("Error getting data source types: %v", err)
-		} else {
-			fields[key] = dataSourceTypes
-		}
-	case "getSubDocTypes":
-		selectMode = ""
-		subDocTypes, err := GetSubDocTypes()
-		if err != nil {
-			log.Printf("Error getting sub document types: %v", err)
-		} else {
-			fields[key] = subDocTypes
-		}
-	case "getDataSourceId":
-		ids, err := GetDataSourceIds()
-		if err != nil {
-			log.Printf("Error getting data source IDs: %v", err)
-		} else {
-			fields[key] = ids
-		}
-	case "getProcessSpecIds":
-		ids, err := GetProcessSpecIds()
-		if err != nil {
-			log.Printf("Error getting process spec IDs: %v", err)
-		} else {
-			fields[key] = ids
-		}
-	case "getIngestDocumentIds":
-		ids, err := GetIngestDocumentIds()
-		if err != nil {
-			log.Printf("Error getting ingest document IDs: %v", err)
-		} else {
-			fields[key] = ids
-		}
-	case "getSubsets":
-		selectMode = ""
-		subsets, err := GetSubsets()
-		if err != nil {
-			log.Printf("Error getting subsets: %v", err)
-			fields[key] = "Error retrieving subsets"
-		} else {
-			fields[key] = subsets
-		}
-	case "getRegions":
-		selectMode = ""
-		regions, err := GetRegions()
-		if err != nil {
-			log.Printf("Error getting regions: %v", err)
-			fields[key] = "Error retrieving regions"
-		} else {
-			fields[key] = regions
-		}
-	case "getCTCSubDocTypes":
-		selectMode = ""
-		subDocTypes, err := GetCTCSubDocTypes()
-		if err != nil {
-			log.Printf("Error getting CTC sub document types: %v", err)
-			fields[key] = "Error retrieving CTC sub document types"
-		} else {
-			fields[key] = subDocTypes
-		}
-	case "getSUMSSubDocTypes":
-		selectMode = ""
-		subDocTypes, err := GetSUMSSubDocTypes()
-		if err != nil {
-			log.Printf("Error getting SUMS sub document types: %v", err)
-			fields[key] = "Error retrieving SUMS sub document types"
-		} else {
-			fields[key] = subDocTypes
-		}
-	case "getTTLTier":
-		selectMode = ""
-		tiers, err := GetTTLTier()
-		if err != nil {
-			log.Printf("Error getting TTL tier: %v", err)
-			fields[key] = "Error retrieving TTL tier"
-		} else {
-			fields[key] = tiers
-		}
-	case "getDataSourceSubTypes":
-		selectMode = ""
-		subTypes, err := GetDataSourceSubTypes()
-		if err != nil {
-			log.Printf("Error getting data source sub types: %v", err)
-			fields[key] = "Error retrieving data source sub types"
-		} else {
-			fields[key] = subTypes
-		}
-	case "getDataSourceStatuses":
-		selectMode = ""
-		statuses, err := GetDataSourceStatuses()
-		if err != nil {
-			log.Printf("Error getting data source statuses: %v", err)
-			fields[key] = "Error retrieving data source statuses"
-		} else {
-			fields[key] = statuses
-		}
-	case "getStatuses":
-		selectMode = ""
-		statuses, err := GetStatuses()
-		if err != nil {
-			log.Printf("Error getting statuses: %v", err)
-			fields[key] = "Error retrieving statuses"
-		} else {
-			fields[key] = statuses
-		}
-	case "getProcessSpecStatuses":
-		selectMode = ""
-		statuses, err := GetProcessSpecStatuses()
-		if err != nil {
-			log.Printf("Error getting process spec statuses: %v", err)
-			fields[key] = "Error retrieving process spec statuses"
-		} else {
-			fields[key] = statuses
-		}
-	default:
+	fn, ok := namedFunctions[funcName]
+	if !ok {
 		if funcName != "" {
 			log.Printf("Unknown function call: %s", funcName)
 			fields[key] = fmt.Sprintf("Unknown function: %s", funcName)
 		}
+		return selectMode
+	}
+	if !fn.multiple {
+		selectMode = ""
+	}
+	if isTypeahead(funcName) {
+		// the options are fetched as the user types
+		fields[key] = ""
+		return selectMode
+	}
+	values, err := fn.lookup()
+	if err != nil {
+		log.Printf("Error getting %s: %v", fn.description, err)
+		if fn.errorField {
+			fields[key] = fmt.Sprintf("Error retrieving %s", fn.description)
+		}
+	} else {
+		fields[key] = values
 	}
 	return selectMode
 }
@@ -733,8 +743,8 @@ func RetrieveFormData(id string) (map[string]interface{}, error) {
 // Update ListDSIDs to ListIDS and update its references
 func ListIDS(docType string) ([]string, error) {
 	cluster := GetConnection(GetCBCredentials())
-	query := fmt.Sprintf("SELECT meta().id FROM vxdata._default.RUNTIME WHERE type = '%s'", docType)
-	result, err := cluster.Query(query, &gocb.QueryOptions{})
+	query := "SELECT meta().id FROM vxdata._default.RUNTIME WHERE type = $type ORDER BY meta().id"
+	result, err := cluster.Query(query, &gocb.QueryOptions{NamedParameters: map[string]interface{}{"type": docType}})
 	if err != nil {
 		return nil, err
 	}
@@ -4,6 +4,7 @@ go 1.24.2
 
 require (
 	github.com/couchbase/gocb/v2 v2.10.1
+	github.com/expr-lang/expr v1.17.8
 	github.com/gin-gonic/gin v1.10.1
 	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// The document graph follows the reference fields of the templates (see
+// references.go) outwards from a root document, and the documents that
+// mention it inwards, up to a given depth.
+
+// GraphNode is a document in the graph.
+type GraphNode struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Collection string `json:"collection"`
+	Missing    bool   `json:"missing,omitempty"`
+}
+
+// GraphEdge is a reference from one document to another, through Field.
+type GraphEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Field string `json:"field"`
+}
+
+// Graph is the neighbourhood of Root.
+type Graph struct {
+	Root      string      `json:"root"`
+	Depth     int         `json:"depth"`
+	Nodes     []GraphNode `json:"nodes"`
+	Edges     []GraphEdge `json:"edges"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+const (
+	defaultGraphDepth = 2
+	maxGraphDepth     = 5
+	maxGraphNodes     = 200
+)
+
+// referenceFields returns the reference fields of all templates. A field
+// declared by several templates keeps the first spec found.
+func referenceFields() (map[string]ReferenceSpec, error) {
+	templates, err := GetFormTemplates()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].TemplateName < templates[j].TemplateName })
+	fields := make(map[string]ReferenceSpec)
+	for _, t := range templates {
+		for key, spec := range t.References {
+			if _, ok := fields[key]; !ok {
+				fields[key] = spec
+			}
+		}
+	}
+	return fields, nil
+}
+
+// graphDocument loads a document for the graph from bucket. Without a known
+// collection RUNTIME is tried first and then COMMON. It fails with
+// gocb.ErrDocumentNotFound when no collection has the document.
+func graphDocument(bucket *gocb.Bucket, id, collection string) (map[string]interface{}, string, error) {
+	collections := []string{collection}
+	if collection == "" {
+		collections = []string{"RUNTIME", "COMMON"}
+	}
+	var lastErr error
+	for _, name := range collections {
+		getResult, err := bucket.Collection(name).Get(id, &gocb.GetOptions{})
+		if errors.Is(err, gocb.ErrDocumentNotFound) {
+			lastErr = err
+			continue
+		}
+		if err != nil {
+			return nil, name, fmt.Errorf("failed to retrieve %s: %w", id, err)
+		}
+		var doc map[string]interface{}
+		if err := getResult.Content(&doc); err != nil {
+			return nil, name, fmt.Errorf("failed to decode content: %w", err)
+		}
+		return doc, name, nil
+	}
+	return nil, collection, lastErr
+}
+
+// graphBuilder walks the graph breadth first, over one connection.
+type graphBuilder struct {
+	cluster *gocb.Cluster
+	bucket  *gocb.Bucket
+	fields  map[string]ReferenceSpec
+	graph   Graph
+	nodes   map[string]bool
+	edges   map[GraphEdge]bool
+}
+
+func (b *graphBuilder) addNode(n GraphNode) bool {
+	if b.nodes[n.ID] {
+		return false
+	}
+	if len(b.graph.Nodes) >= maxGraphNodes {
+		b.graph.Truncated = true
+		return false
+	}
+	b.nodes[n.ID] = true
+	b.graph.Nodes = append(b.graph.Nodes, n)
+	return true
+}
+
+func (b *graphBuilder) addEdge(e GraphEdge) {
+	if !b.edges[e] {
+		b.edges[e] = true
+		b.graph.Edges = append(b.graph.Edges, e)
+	}
+}
+
+// outgoing returns the documents doc refers to through reference fields,
+// grouped by field.
+func (b *graphBuilder) outgoing(doc map[string]interface{}) map[string][]string {
+	out := make(map[string][]string)
+	for key := range b.fields {
+		if ids := referencedIDs(doc[key]); len(ids) > 0 {
+			out[key] = ids
+		}
+	}
+	return out
+}
+
+// load fetches the document of node id and records its type and collection,
+// or that it is missing.
+func (b *graphBuilder) load(id string) map[string]interface{} {
+	for i := range b.graph.Nodes {
+		n := &b.graph.Nodes[i]
+		if n.ID != id {
+			continue
+		}
+		doc, found, err := graphDocument(b.bucket, id, n.Collection)
+		n.Collection = found
+		if err != nil {
+			n.Missing = true
+			return nil
+		}
+		n.Type, _ = doc["type"].(string)
+		return doc
+	}
+	return nil
+}
+
+// visit loads id and adds its neighbours, returning the ids still to visit.
+func (b *graphBuilder) visit(id string) []string {
+	doc := b.load(id)
+	if doc == nil {
+		return nil
+	}
+	var next []string
+	out := b.outgoing(doc)
+	fields := make([]string, 0, len(out))
+	for field := range out {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		spec := b.fields[field]
+		for _, ref := range out[field] {
+			if b.addNode(GraphNode{ID: ref, Type: spec.Type, Collection: spec.Collection}) {
+				next = append(next, ref)
+			}
+			if b.nodes[ref] {
+				b.addEdge(GraphEdge{From: id, To: ref, Field: field})
+			}
+		}
+	}
+	referrers, err := findReferences(b.cluster, id)
+	if err != nil {
+		return next
+	}
+	for _, ref := range referrers {
+		if b.addNode(GraphNode{ID: ref, Collection: "RUNTIME"}) {
+			next = append(next, ref)
+		}
+		if !b.nodes[ref] {
+			continue
+		}
+		// name the edge after the field of the referrer that holds id
+		field := ""
+		if refDoc, _, err := graphDocument(b.bucket, ref, "RUNTIME"); err == nil {
+			for key, ids := range b.outgoing(refDoc) {
+				if containsString(ids, id) && (field == "" || key < field) {
+					field = key
+				}
+			}
+		}
+		b.addEdge(GraphEdge{From: ref, To: id, Field: field})
+	}
+	return next
+}
+
+// BuildGraph returns the documents within depth references of root.
+func BuildGraph(root string, depth int) (Graph, error) {
+	if depth <= 0 {
+		depth = defaultGraphDepth
+	}
+	if depth > maxGraphDepth {
+		depth = maxGraphDepth
+	}
+	fields, err := referenceFields()
+	if err != nil {
+		return Graph{}, err
+	}
+	cluster := GetConnection(GetCBCredentials())
+	defer cluster.Close(nil)
+	b := &graphBuilder{
+		cluster: cluster,
+		bucket:  cluster.Bucket(GetCBCredentials().CBBucket),
+		fields:  fields,
+		graph:   Graph{Root: root, Depth: depth},
+		nodes:   make(map[string]bool),
+		edges:   make(map[GraphEdge]bool),
+	}
+	_, found, err := graphDocument(b.bucket, root, "")
+	if err != nil {
+		return Graph{}, fmt.Errorf("document %s: %w", root, err)
+	}
+	b.addNode(GraphNode{ID: root, Collection: found})
+	level := []string{root}
+	for d := 0; d <= depth && len(level) > 0; d++ {
+		var next []string
+		for _, id := range level {
+			if d == depth {
+				// the outer ring is only loaded, not expanded
+				b.load(id)
+				continue
+			}
+			next = append(next, b.visit(id)...)
+		}
+		level = next
+	}
+	sort.Slice(b.graph.Edges, func(i, j int) bool {
+		ei, ej := b.graph.Edges[i], b.graph.Edges[j]
+		if ei.From != ej.From {
+			return ei.From < ej.From
+		}
+		if ei.To != ej.To {
+			return ei.To < ej.To
+		}
+		return ei.Field < ej.Field
+	})
+	return b.graph, nil
+}
+
+// nodeLabel is the text shown for a node in the exports.
+func nodeLabel(n GraphNode) string {
+	if n.Type == "" {
+		return n.ID
+	}
+	return n.Type + "\n" + n.ID
+}
+
+// DOT renders g in Graphviz DOT.
+func (g Graph) DOT() string {
+	var sb strings.Builder
+	sb.WriteString("digraph references {\n")
+	sb.WriteString("  rankdir=LR;\n  node [shape=box, fontname=\"Helvetica\"];\n")
+	for _, n := range g.Nodes {
+		attrs := "label=" + strconv.Quote(nodeLabel(n))
+		if n.ID == g.Root {
+			attrs += ", style=bold"
+		}
+		if n.Missing {
+			attrs += ", style=dashed, color=red"
+		}
+		fmt.Fprintf(&sb, "  %s [%s];\n", strconv.Quote(n.ID), attrs)
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(&sb, "  %s -> %s", strconv.Quote(e.From), strconv.Quote(e.To))
+		if e.Field != "" {
+			fmt.Fprintf(&sb, " [label=%s]", strconv.Quote(e.Field))
+		}
+		sb.WriteString(";\n")
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// mermaidText escapes text for a quoted Mermaid label.
+func mermaidText(s string) string {
+	s = strings.ReplaceAll(s, "\"", "#quot;")
+	return strings.ReplaceAll(s, "\n", "<br/>")
+}
+
+// Mermaid renders g as a Mermaid flowchart. Document ids are not valid
+// Mermaid node ids, so the nodes are numbered and labelled with their id.
+func (g Graph) Mermaid() string {
+	var sb strings.Builder
+	sb.WriteString("flowchart LR\n")
+	names := make(map[string]string, len(g.Nodes))
+	for i, n := range g.Nodes {
+		names[n.ID] = fmt.Sprintf("n%d", i)
+		fmt.Fprintf(&sb, "  %s[\"%s\"]\n", names[n.ID], mermaidText(nodeLabel(n)))
+	}
+	for _, e := range g.Edges {
+		if e.Field != "" {
+			fmt.Fprintf(&sb, "  %s -->|\"%s\"| %s\n", names[e.From], mermaidText(e.Field), names[e.To])
+		} else {
+			fmt.Fprintf(&sb, "  %s --> %s\n", names[e.From], names[e.To])
+		}
+	}
+	if root, ok := names[g.Root]; ok {
+		fmt.Fprintf(&sb, "  style %s stroke-width:3px\n", root)
+	}
+	return sb.String()
+}
+
+// graphHandler returns the graph of ?root=<id> as JSON, or with
+// ?format=dot|mermaid as text. ?depth sets how far references are followed.
+func graphHandler(c *gin.Context) {
+	root := c.Query("root")
+	if root == "" {
+		c.String(http.StatusBadRequest, "Missing root")
+		return
+	}
+	depth, _ := strconv.Atoi(c.Query("depth"))
+	g, err := BuildGraph(root, depth)
+	switch {
+	case errors.Is(err, gocb.ErrDocumentNotFound):
+		c.String(http.StatusNotFound, fmt.Sprintf("Not found: %v", err))
+		return
+	case err != nil:
+		c.String(http.StatusInternalServerError, "Failed to build the graph")
+		return
+	}
+	switch c.Query("format") {
+	case "dot":
+		c.String(http.StatusOK, g.DOT())
+	case "mermaid":
+		c.String(http.StatusOK, g.Mermaid())
+	default:
+		c.JSON(http.StatusOK, g)
+	}
+}
+
+// graphPage shows the interactive view of ?root=<id>.
+func graphPage(c *gin.Context) {
+	data := topNavData()
+	data["root"] = c.Query("root")
+	depth, _ := strconv.Atoi(c.Query("depth"))
+	if depth <= 0 {
+		depth = defaultGraphDepth
+	}
+	if depth > maxGraphDepth {
+		depth = maxGraphDepth
+	}
+	data["depth"] = depth
+	var depths []int
+	for d := 1; d <= maxGraphDepth; d++ {
+		depths = append(depths, d)
+	}
+	data["depths"] = depths
+	c.HTML(http.StatusOK, "graph.html", data)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// The status metadata documents may restrict how a status can change:
+//
+//	"MD:V01:DataSourceStatuses": {
+//	    "statuses": ["draft", "active", "retired"],
+//	    "initial": ["draft"],
+//	    "transitions": {"draft": ["active"], "active": ["retired"], "retired": []}
+//	}
+//
+// "initial" are the statuses a new document may start in (any, if absent) and
+// "transitions" the statuses each status may change to. Keeping the same
+// status is always allowed. Without "transitions" any change is allowed.
+// Clearing a status is a transition to "", and a stored document without a
+// status moves on by the transitions of "", so "active": ["retired", ""]
+// allows clearing an active status and "": ["draft"] gives a status to a
+// stored document that has none. Every change is recorded in the document's
+// statusHistory.
+
+// statusMetadata maps the status lookups to the metadata document holding
+// their statuses.
+var statusMetadata = map[string]string{
+	"getStatuses":            "MD:V01:Statuses",
+	"getDataSourceStatuses":  "MD:V01:DataSourceStatuses",
+	"getProcessSpecStatuses": "MD:V01:ProcessSpecStatuses",
+}
+
+// StatusLifecycle is the transitions of one status metadata document.
+type StatusLifecycle struct {
+	Initial     []string            `json:"initial,omitempty"`
+	Transitions map[string][]string `json:"transitions"`
+}
+
+// StatusChange is an entry of a document's statusHistory.
+type StatusChange struct {
+	Field string `json:"field"`
+	From  string `json:"from,omitempty"`
+	To    string `json:"to"`
+	At    int64  `json:"at"`
+	Via   string `json:"via,omitempty"` // commit, bulk-edit or patch
+}
+
+// lifecycles caches the lifecycles by metadata id; nil when a metadata
+// document has no transitions.
+var lifecycles map[string]*StatusLifecycle
+
+// GetStatusLifecycle returns the lifecycle of a status metadata document, or
+// nil when its statuses may change freely.
+func GetStatusLifecycle(metadataID string) (*StatusLifecycle, error) {
+	if lifecycles == nil {
+		cluster := GetConnection(GetCBCredentials())
+		ids := make([]string, 0, len(statusMetadata))
+		for _, id := range statusMetadata {
+			ids = append(ids, id)
+		}
+		query := "SELECT meta().id AS id, initial, transitions FROM vxdata._default.COMMON USE KEYS $ids"
+		result, err := cluster.Query(query, &gocb.QueryOptions{NamedParameters: map[string]interface{}{"ids": ids}})
+		if err != nil {
+			return nil, err
+		}
+		loaded := make(map[string]*StatusLifecycle)
+		for result.Next() {
+			var row struct {
+				ID string `json:"id"`
+				StatusLifecycle
+			}
+			if err := result.Row(&row); err == nil && row.Transitions != nil {
+				l := row.StatusLifecycle
+				loaded[row.ID] = &l
+			}
+		}
+		lifecycles = loaded
+	}
+	return lifecycles[metadataID], nil
+}
+
+// Allowed returns the statuses a document in status from may be given. A new
+// document (stored false) may be given the initial statuses.
+func (l *StatusLifecycle) Allowed(from string, stored bool, statuses []string) []string {
+	if !stored {
+		if len(l.Initial) == 0 {
+			return statuses
+		}
+		return l.Initial
+	}
+	allowed := []string{from}
+	for _, to := range l.Transitions[from] {
+		if to != from {
+			allowed = append(allowed, to)
+		}
+	}
+	return allowed
+}
+
+// statusFields returns the status fields of t with their lifecycle, leaving
+// out those that may change freely.
+func (t FormTemplate) statusFields() (map[string]*StatusLifecycle, error) {
+	fields := make(map[string]*StatusLifecycle)
+	for key, fn := range t.Functions {
+		metadataID, ok := statusMetadata[fn]
+		if !ok {
+			continue
+		}
+		l, err := GetStatusLifecycle(metadataID)
+		if err != nil {
+			return nil, err
+		}
+		if l != nil {
+			fields[key] = l
+		}
+	}
+	return fields, nil
+}
+
+// AllowedStatuses returns, for each status field of t, the statuses a
+// document currently in doc (nil for a new document) may be given.
+func (t FormTemplate) AllowedStatuses(doc map[string]interface{}) (map[string][]string, error) {
+	fields, err := t.statusFields()
+	if err != nil {
+		return nil, err
+	}
+	allowed := make(map[string][]string, len(fields))
+	for key, l := range fields {
+		from, _ := doc[key].(string)
+		statuses, _ := CallNamedFunction(t.Functions[key])
+		allowed[key] = l.Allowed(from, doc != nil, statuses)
+	}
+	return allowed, nil
+}
+
+// StatusChanges checks the status changes from stored (nil for a new
+// document) to doc against the lifecycles, and returns them for the history.
+func (t FormTemplate) StatusChanges(stored, doc map[string]interface{}, via string) ([]StatusChange, error) {
+	fields, err := t.statusFields()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load status transitions: %w", err)
+	}
+	keys := make([]string, 0, len(t.Functions))
+	for key, fn := range t.Functions {
+		if _, ok := statusMetadata[fn]; ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	now := time.Now().Unix()
+	var changes []StatusChange
+	var problems []string
+	for _, key := range keys {
+		from, _ := stored[key].(string)
+		to, _ := doc[key].(string)
+		if from == to {
+			continue
+		}
+		if l := fields[key]; l != nil {
+			statuses, _ := CallNamedFunction(t.Functions[key])
+			if allowed := l.Allowed(from, stored != nil, statuses); !containsString(allowed, to) {
+				switch {
+				case stored == nil:
+					problems = append(problems, fmt.Sprintf("%s cannot start as %q, only as %s", key, to, strings.Join(allowed, ", ")))
+				case to == "":
+					problems = append(problems, fmt.Sprintf("%s cannot be cleared from %q", key, from))
+				default:
+					problems = append(problems, fmt.Sprintf("%s cannot change from %q to %q, only to %s", key, from, to, strings.Join(allowed, ", ")))
+				}
+				continue
+			}
+		}
+		changes = append(changes, StatusChange{Field: key, From: from, To: to, At: now, Via: via})
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("status transition not allowed: %s", strings.Join(problems, "; "))
+	}
+	return changes, nil
+}
+
+// storedDocument returns the RUNTIME document with the given id, or nil when
+// there is none.
+func storedDocument(cluster *gocb.Cluster, id string) (map[string]interface{}, error) {
+	collection := cluster.Bucket(GetCBCredentials().CBBucket).Collection("RUNTIME")
+	getResult, err := collection.Get(id, &gocb.GetOptions{})
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve data: %w", err)
+	}
+	var doc map[string]interface{}
+	if err := getResult.Content(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode content: %w", err)
+	}
+	return doc, nil
+}
+
+// withStatusHistory returns doc carrying the statusHistory of stored with
+// changes appended. Whatever history doc came with is replaced, so it cannot
+// be rewritten by the client.
+func withStatusHistory(doc, stored map[string]interface{}, changes []StatusChange) map[string]interface{} {
+	var history []interface{}
+	if h, ok := stored["statusHistory"].([]interface{}); ok {
+		history = append(history, h...)
+	}
+	for _, ch := range changes {
+		history = append(history, ch)
+	}
+	if len(history) > 0 {
+		doc["statusHistory"] = history
+	} else {
+		delete(doc, "statusHistory")
+	}
+	return doc
+}
+
+// ApplyLifecycle checks the status changes a commit of doc makes against the
+// stored document with the same id and records them in its statusHistory.
+func (t FormTemplate) ApplyLifecycle(cluster *gocb.Cluster, doc map[string]interface{}) (map[string]interface{}, error) {
+	id, _ := doc["id"].(string)
+	stored, err := storedDocument(cluster, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the stored document: %w", err)
+	}
+	changes, err := t.StatusChanges(stored, doc, "commit")
+	if err != nil {
+		return nil, err
+	}
+	return withStatusHistory(doc, stored, changes), nil
+}
+
+// ApplyDocumentLifecycle is ApplyLifecycle for a document committed without
+// naming its template, which is then found from the document itself. A
+// document without a template has no status rules, but still keeps the
+// statusHistory it has.
+func ApplyDocumentLifecycle(cluster *gocb.Cluster, doc map[string]interface{}) (map[string]interface{}, error) {
+	templates, err := GetFormTemplates()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load templates: %w", err)
+	}
+	if t, ok := templateForDocument(templates, doc); ok {
+		return t.ApplyLifecycle(cluster, doc)
+	}
+	id, _ := doc["id"].(string)
+	stored, err := storedDocument(cluster, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the stored document: %w", err)
+	}
+	return withStatusHistory(doc, stored, nil), nil
+}
+
+// transitionsHandler returns, for ?template=<name>, the statuses each status
+// field may be given: from the current status of ?id=<id>, or for a new
+// document.
+func transitionsHandler(c *gin.Context) {
+	t, err := FindFormTemplate(c.Query("template"))
+	if err != nil {
+		c.String(http.StatusNotFound, fmt.Sprintf("Error: %v", err))
+		return
+	}
+	var stored map[string]interface{}
+	if id := c.Query("id"); id != "" {
+		cluster := GetConnection(GetCBCredentials())
+		defer cluster.Close(nil)
+		if stored, err = storedDocument(cluster, id); err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load the document")
+			return
+		}
+	}
+	allowed, err := t.AllowedStatuses(stored)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to load status transitions")
+		return
+	}
+	c.JSON(http.StatusOK, allowed)
+}
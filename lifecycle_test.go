@@ -0,0 +1,124 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStatusLifecycleAllowed(t *testing.T) {
+	statuses := []string{"draft", "active", "retired"}
+	lifecycle := &StatusLifecycle{
+		Initial: []string{"draft"},
+		Transitions: map[string][]string{
+			"draft":   {"active", "draft"},
+			"active":  {"retired"},
+			"retired": {},
+		},
+	}
+	tests := []struct {
+		name      string
+		lifecycle *StatusLifecycle
+		from      string
+		stored    bool
+		want      []string
+	}{
+		{name: "new document", lifecycle: lifecycle, from: "", want: []string{"draft"}},
+		{name: "new document without initial", lifecycle: &StatusLifecycle{Transitions: lifecycle.Transitions}, from: "", want: statuses},
+		{name: "stored document without a status", lifecycle: lifecycle, from: "", stored: true, want: []string{""}},
+		{name: "keeps the status first", lifecycle: lifecycle, from: "draft", stored: true, want: []string{"draft", "active"}},
+		{name: "one way", lifecycle: lifecycle, from: "active", stored: true, want: []string{"active", "retired"}},
+		{name: "final status", lifecycle: lifecycle, from: "retired", stored: true, want: []string{"retired"}},
+		{name: "status without transitions", lifecycle: lifecycle, from: "unknown", stored: true, want: []string{"unknown"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.lifecycle.Allowed(tt.from, tt.stored, statuses); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Allowed(%q, %v) = %v, want %v", tt.from, tt.stored, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithStatusHistory(t *testing.T) {
+	change := StatusChange{Field: "status", From: "draft", To: "active", At: 1700000000, Via: "commit"}
+	stored := map[string]interface{}{
+		"statusHistory": []interface{}{map[string]interface{}{"field": "status", "to": "draft"}},
+	}
+	forged := []interface{}{"forged"}
+
+	doc := withStatusHistory(map[string]interface{}{"statusHistory": forged}, nil, nil)
+	if _, ok := doc["statusHistory"]; ok {
+		t.Errorf("a new document kept the history it came with: %v", doc["statusHistory"])
+	}
+	doc = withStatusHistory(map[string]interface{}{"statusHistory": forged}, stored, nil)
+	if want := stored["statusHistory"]; !reflect.DeepEqual(doc["statusHistory"], want) {
+		t.Errorf("statusHistory = %v, want the stored %v", doc["statusHistory"], want)
+	}
+	doc = withStatusHistory(map[string]interface{}{"statusHistory": forged}, stored, []StatusChange{change})
+	want := append(append([]interface{}{}, stored["statusHistory"].([]interface{})...), change)
+	if !reflect.DeepEqual(doc["statusHistory"], want) {
+		t.Errorf("statusHistory = %v, want %v", doc["statusHistory"], want)
+	}
+}
+
+func TestStatusChanges(t *testing.T) {
+	// the lookups are cached, so the test needs no database
+	savedStatuses, savedLifecycles := statuses, lifecycles
+	defer func() { statuses, lifecycles = savedStatuses, savedLifecycles }()
+	statuses = []string{"draft", "active", "retired"}
+	lifecycles = map[string]*StatusLifecycle{
+		"MD:V01:Statuses": {
+			Initial: []string{"draft"},
+			Transitions: map[string][]string{
+				"draft":   {"active", ""},
+				"active":  {"retired"},
+				"retired": {},
+				"":        {"draft"},
+			},
+		},
+	}
+	tmpl := FormTemplate{Functions: map[string]string{"status": "getStatuses"}}
+	doc := func(status string) map[string]interface{} {
+		if status == "-" {
+			return map[string]interface{}{}
+		}
+		return map[string]interface{}{"status": status}
+	}
+	tests := []struct {
+		name     string
+		stored   map[string]interface{}
+		to       string
+		wantErr  bool
+		recorded bool
+	}{
+		{name: "new document in an initial status", stored: nil, to: "draft", recorded: true},
+		{name: "new document in another status", stored: nil, to: "active", wantErr: true},
+		{name: "new document without a status", stored: nil, to: "", recorded: false},
+		{name: "allowed transition", stored: doc("draft"), to: "active", recorded: true},
+		{name: "transition not allowed", stored: doc("active"), to: "draft", wantErr: true},
+		{name: "same status", stored: doc("retired"), to: "retired", recorded: false},
+		{name: "clearing allowed", stored: doc("draft"), to: "", recorded: true},
+		{name: "clearing not allowed", stored: doc("retired"), to: "", wantErr: true},
+		{name: "removing not allowed", stored: doc("retired"), to: "-", wantErr: true},
+		{name: "cleared status is not a new document", stored: doc(""), to: "active", wantErr: true},
+		{name: "missing status is not a new document", stored: doc("-"), to: "active", wantErr: true},
+		{name: "cleared status moves on by the transitions of empty", stored: doc(""), to: "draft", recorded: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes, err := tmpl.StatusChanges(tt.stored, doc(tt.to), "commit")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("StatusChanges allowed the change, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("StatusChanges failed: %v", err)
+			}
+			if got := len(changes) > 0; got != tt.recorded {
+				t.Errorf("recorded a change: %v, want %v", got, tt.recorded)
+			}
+		})
+	}
+}
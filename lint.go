@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/expr-lang/expr"
+)
+
+// LintIssue is a single problem found in a template document.
+type LintIssue struct {
+	Template string `json:"template"`
+	DocID    string `json:"docId"`
+	Field    string `json:"field,omitempty"`
+	Severity string `json:"severity"` // "error" or "warning"
+	Message  string `json:"message"`
+}
+
+const (
+	LintError   = "error"
+	LintWarning = "warning"
+)
+
+// LintTemplates checks every template document: the structure GetFormTemplates
+// relies on, the "&", "#", "@", "*" and "=" conventions, the id pattern, the
+// template metadata objects, inheritance, and duplicate templateNames.
+func LintTemplates(raw []map[string]interface{}, fragments map[string]map[string]interface{}) []LintIssue {
+	var issues []LintIssue
+	seen := make(map[string]string)
+	resolver := newTemplateResolver(raw, fragments)
+	for _, doc := range raw {
+		name, _ := doc["templateName"].(string)
+		docID, _ := doc["docId"].(string)
+		if name == "" {
+			issues = append(issues, LintIssue{DocID: docID, Severity: LintError, Message: "missing templateName"})
+		} else if other, ok := seen[name]; ok {
+			issues = append(issues, LintIssue{Template: name, DocID: docID, Severity: LintError,
+				Message: fmt.Sprintf("duplicate templateName, also used by %s", other)})
+		} else {
+			seen[name] = docID
+		}
+		issues = append(issues, LintTemplateDocument(doc, resolver)...)
+	}
+	sortLintIssues(issues)
+	return issues
+}
+
+// LintTemplateDocument checks one template document. Inheritance is resolved
+// with resolver first so that inherited fields are checked too.
+func LintTemplateDocument(doc map[string]interface{}, resolver templateResolver) []LintIssue {
+	name, _ := doc["templateName"].(string)
+	docID, _ := doc["docId"].(string)
+	issue := func(field, severity, format string, args ...interface{}) LintIssue {
+		return LintIssue{Template: name, DocID: docID, Field: field, Severity: severity, Message: fmt.Sprintf(format, args...)}
+	}
+
+	if _, ok := doc["template"].(map[string]interface{}); !ok && doc["extends"] == nil {
+		if doc["template"] == nil {
+			return []LintIssue{issue("", LintError, "missing \"template\" object")}
+		}
+		return []LintIssue{issue("", LintError, "\"template\" is not an object")}
+	}
+	merged, err := resolver.resolve(doc)
+	if err != nil {
+		return []LintIssue{issue("", LintError, "%v", err)}
+	}
+	template, ok := merged["template"].(map[string]interface{})
+	if !ok {
+		return []LintIssue{issue("", LintError, "missing \"template\" object")}
+	}
+
+	var issues []LintIssue
+	fields := make(map[string]bool, len(template))
+	for key := range template {
+		fields[strings.TrimPrefix(key, "@")] = true
+	}
+	for key, value := range template {
+		s, isString := value.(string)
+		switch {
+		case strings.HasPrefix(key, "@"):
+			if isString {
+				issues = append(issues, issue(key, LintError, "\"@\" field must hold a JSON object or array, not a string"))
+			}
+			continue
+		case !isString:
+			continue
+		}
+		switch {
+		case strings.HasPrefix(s, "&"):
+			if _, ok := namedFunctions[strings.TrimPrefix(s, "&")]; !ok {
+				issues = append(issues, issue(key, LintError, "unknown function %s", s))
+			}
+		case strings.HasPrefix(s, "="):
+			if _, err := expr.Compile(strings.TrimPrefix(s, "="), expr.AllowUndefinedVariables()); err != nil {
+				issues = append(issues, issue(key, LintError, "invalid expression: %v", err))
+			}
+		case strings.HasPrefix(s, "#"):
+			constant := strings.TrimPrefix(s, "#")
+			if constant == "" {
+				issues = append(issues, issue(key, LintWarning, "\"#\" constant is empty"))
+			}
+			if strings.HasPrefix(constant, "&") || strings.HasPrefix(constant, "=") {
+				issues = append(issues, issue(key, LintError, "\"#\" constant cannot be combined with %q", constant[:1]))
+			}
+		}
+		for _, p := range ParsePlaceholders(s) {
+			if !fields[p.Name] {
+				severity := LintWarning
+				if key == "id" {
+					severity = LintError
+				}
+				issues = append(issues, issue(key, severity, "placeholder *%s does not name a field", p.Name))
+			} else if p.Name == strings.TrimPrefix(key, "@") {
+				issues = append(issues, issue(key, LintError, "placeholder *%s refers to its own field", p.Name))
+			}
+		}
+	}
+
+	id, hasID := template["id"]
+	if !hasID {
+		issues = append(issues, issue("id", LintError, "template has no id field"))
+	} else if idStr, ok := id.(string); !ok {
+		issues = append(issues, issue("id", LintError, "id must be a string"))
+	} else if strings.Count(idStr, "*") != len(ParsePlaceholders(idStr)) {
+		issues = append(issues, issue("id", LintError, "id contains a '*' that is not a placeholder"))
+	}
+
+	for key, kind := range parseFieldKinds(merged) {
+		if !fields[key] {
+			issues = append(issues, issue(key, LintWarning, "fieldKinds names an unknown field"))
+		}
+		if kind != KindEpoch && kind != KindDuration {
+			issues = append(issues, issue(key, LintError, "unknown field kind %q", kind))
+		}
+	}
+	for key, condition := range parseVisibleWhen(merged) {
+		if !fields[strings.TrimPrefix(key, "@")] {
+			issues = append(issues, issue(key, LintWarning, "visibleWhen names an unknown field"))
+		}
+		if _, err := expr.Compile(condition, expr.AllowUndefinedVariables(), expr.AsBool()); err != nil {
+			issues = append(issues, issue(key, LintError, "invalid visibleWhen condition: %v", err))
+		}
+	}
+	for key, d := range parseDependentOptions(merged) {
+		if !fields[key] {
+			issues = append(issues, issue(key, LintWarning, "dependentOptions names an unknown field"))
+		}
+		if !fields[d.DependsOn] {
+			issues = append(issues, issue(key, LintError, "depends on unknown field %s", d.DependsOn))
+		}
+		for value, spec := range d.Options {
+			if fn, ok := spec.(string); ok {
+				if _, known := namedFunctions[strings.TrimPrefix(fn, "&")]; !strings.HasPrefix(fn, "&") || !known {
+					issues = append(issues, issue(key, LintError, "options for %s=%s: unknown function %s", d.DependsOn, value, fn))
+				}
+			}
+		}
+	}
+	for key, spec := range parseReferences(merged, nil) {
+		if !fields[key] {
+			issues = append(issues, issue(key, LintWarning, "references names an unknown field"))
+		}
+		if spec.Type == "" {
+			issues = append(issues, issue(key, LintWarning, "reference has no type"))
+		}
+		if !isCollectionName(spec.Collection) {
+			issues = append(issues, issue(key, LintError, "invalid reference collection %q", spec.Collection))
+		}
+	}
+	if field := parseExpiryTier(merged); field != "" {
+		if !fields[field] {
+			issues = append(issues, issue(field, LintError, "expiryTier names an unknown field"))
+		} else if template[field] != "&getTTLTier" {
+			issues = append(issues, issue(field, LintWarning, "expiryTier field does not use &getTTLTier"))
+		}
+	}
+	revision := templateRevision(doc)
+	for _, m := range parseMigrations(doc) {
+		if m.ToRevision > revision+1 {
+			issues = append(issues, issue("", LintWarning, "migration to revision %d is beyond the next revision %d", m.ToRevision, revision+1))
+		}
+		for _, rule := range m.Rules {
+			switch rule.Op {
+			case "rename", "default", "remove":
+			case "transform":
+				if _, err := expr.Compile(rule.Expr, expr.AllowUndefinedVariables()); err != nil {
+					issues = append(issues, issue(rule.Field, LintError, "invalid migration transform: %v", err))
+				}
+			default:
+				issues = append(issues, issue(rule.Field, LintError, "unknown migration op %q", rule.Op))
+			}
+			if rule.Op == "rename" && rule.To == "" {
+				issues = append(issues, issue(rule.Field, LintError, "rename migration has no \"to\" field"))
+			}
+		}
+	}
+	return issues
+}
+
+// lintErrorCount returns the number of issues with error severity.
+func lintErrorCount(issues []LintIssue) int {
+	n := 0
+	for _, i := range issues {
+		if i.Severity == LintError {
+			n++
+		}
+	}
+	return n
+}
+
+func sortLintIssues(issues []LintIssue) {
+	sort.SliceStable(issues, func(i, j int) bool {
+		if issues[i].Template != issues[j].Template {
+			return issues[i].Template < issues[j].Template
+		}
+		if issues[i].Field != issues[j].Field {
+			return issues[i].Field < issues[j].Field
+		}
+		return issues[i].Message < issues[j].Message
+	})
+}
+
+// LintStoredTemplates lints the template documents in COMMON.
+func LintStoredTemplates() ([]LintIssue, error) {
+	raw, err := GetRawTemplateDocuments()
+	if err != nil {
+		return nil, err
+	}
+	fragments, err := GetTemplateFragments()
+	if err != nil {
+		return nil, err
+	}
+	return LintTemplates(raw, fragments), nil
+}
+
+// LintCandidate lints an unsaved template document as if it replaced the
+// stored document with the same docId, returning only its own issues.
+func LintCandidate(doc map[string]interface{}) ([]LintIssue, error) {
+	raw, err := GetRawTemplateDocuments()
+	if err != nil {
+		return nil, err
+	}
+	fragments, err := GetTemplateFragments()
+	if err != nil {
+		return nil, err
+	}
+	docID, _ := doc["docId"].(string)
+	var issues []LintIssue
+	for _, i := range LintTemplates(withCandidate(raw, doc), fragments) {
+		if i.DocID == docID {
+			issues = append(issues, i)
+		}
+	}
+	return issues, nil
+}
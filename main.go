@@ -3,15 +3,39 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 
+	"github.com/couchbase/gocb/v2"
 	"github.com/gin-gonic/gin"
 )
 
+// topNavData returns the page data used by the topNav and footer templates.
+func topNavData() gin.H {
+	return gin.H{
+		"FlagLogo":       "/static/img/us_flag_small.png",
+		"GovLogo":        "/static/img/icon-dot-gov.svg",
+		"HttpsLogo":      "/static/img/icon-https.svg",
+		"TransparentGif": "/static/img/noaa_transparent.gif",
+		"ProductLink":    "/",
+		"ProductText":    "vxFormsUI",
+		"AgencyLink":     "https://gsl.noaa.gov/",
+		"AgencyText":     "Global Systems Laboratory",
+		"BugsLink":       "https://github.com/NOAA-GSL/vxFormsUI/issues",
+		"BugsText":       "Bugs/Issues (GitHub)",
+		"EmailText":      "mailto:mats.gsl@noaa.gov?Subject=Feedback from vxFormsUI",
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
 	r := gin.Default()
 	// Custom function to check if a string contains a substring
 	r.SetFuncMap(template.FuncMap{
@@ -45,6 +69,8 @@ func main() {
 			_, ok := v.(string)
 			return ok
 		},
+		"EpochInput":   FormatEpoch,
+		"DurationText": FormatDuration,
 	})
 	r.Static("/static", "./static")
 	r.Static("/img", "./static/img")
@@ -56,20 +82,8 @@ func main() {
 			c.String(http.StatusInternalServerError, "Error loading forms")
 			return
 		}
-		data := gin.H{
-			"FlagLogo":       "./static/img/us_flag_small.png",
-			"GovLogo":        "./static/img/icon-dot-gov.svg",
-			"HttpsLogo":      "./static/img/icon-https.svg",
-			"TransparentGif": "./static/img/noaa_transparent.gif",
-			"ProductLink":    "/",
-			"ProductText":    "vxFormsUI",
-			"AgencyLink":     "https://gsl.noaa.gov/",
-			"AgencyText":     "Global Systems Laboratory",
-			"BugsLink":       "https://github.com/NOAA-GSL/vxFormsUI/issues",
-			"BugsText":       "Bugs/Issues (GitHub)",
-			"EmailText":      "mailto:mats.gsl@noaa.gov?Subject=Feedback from vxFormsUI",
-			"forms":          templates,
-		}
+		data := topNavData()
+		data["forms"] = templates
 
 		c.HTML(http.StatusOK, "index.html", data)
 	})
@@ -94,14 +108,62 @@ func main() {
 			c.String(http.StatusBadRequest, "Invalid JSON")
 			return
 		}
+		// When the form tells us which template it came from, the document is
+		// prepared here rather than trusting the browser's substitution.
+		// Without a template the stored document keeps its expiry.
+		cluster := GetConnection(GetCBCredentials())
+		defer cluster.Close(nil)
+		var expiry time.Duration
+		preserveExpiry := true
+		templateName := c.Query("template")
+		if templateName != "" {
+			t, err := FindFormTemplate(templateName)
+			if err != nil {
+				c.String(http.StatusBadRequest, fmt.Sprintf("Error: %v", err))
+				return
+			}
+			prepared, err := t.PrepareDocument(cluster, data)
+			if err != nil {
+				c.String(http.StatusBadRequest, fmt.Sprintf("Error: %v. Cannot commit.", err))
+				return
+			}
+			data = prepared
+			if expiry, preserveExpiry, err = t.commitExpiry(cluster, data); err != nil {
+				c.String(http.StatusBadRequest, fmt.Sprintf("Error: %v. Cannot commit.", err))
+				return
+			}
+		}
 		id, ok := data["id"].(string)
 		if !ok || strings.Contains(id, "*") || id == "" {
 			c.String(http.StatusBadRequest, "Error: The id field is missing or contains '*'. Cannot commit.")
 			return
 		}
+		if templateName == "" {
+			// raw JSON commits keep to the status lifecycle as well
+			checked, err := ApplyDocumentLifecycle(cluster, data)
+			if err != nil {
+				c.String(http.StatusBadRequest, fmt.Sprintf("Error: %v. Cannot commit.", err))
+				return
+			}
+			data = checked
+		}
 
-		// Assume you have a function UpsertFormData(id string, data map[string]interface{}) error
-		err := UpsertFormData(id, data)
+		// ?mode=create (used by Clone) never overwrites an existing document
+		if c.Query("mode") == "create" {
+			err := InsertFormData(id, data, expiry)
+			if errors.Is(err, gocb.ErrDocumentExists) {
+				c.String(http.StatusConflict, fmt.Sprintf("Error: a document with id %s already exists. Change the id to commit a new document.", id))
+				return
+			}
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Failed to insert data to database")
+				return
+			}
+			c.String(http.StatusOK, fmt.Sprintf("Created form data with id: %s", id))
+			return
+		}
+
+		err := UpsertFormData(id, data, expiry, preserveExpiry)
 		if err != nil {
 			c.String(http.StatusInternalServerError, "Failed to upsert data to database")
 			return
@@ -110,6 +172,85 @@ func main() {
 
 	})
 
+	r.POST("/commit-batch", commitBatchHandler)
+
+	r.POST("/resolve", func(c *gin.Context) {
+		var req struct {
+			TemplateName string                 `json:"templateName"`
+			Values       map[string]interface{} `json:"values"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.String(http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+		t, err := FindFormTemplate(req.TemplateName)
+		if err != nil {
+			c.String(http.StatusNotFound, fmt.Sprintf("Error: %v", err))
+			return
+		}
+		// values that do not convert yet are simply left as typed
+		values, _ := t.ConvertKinds(req.Values)
+		computed, errs := t.ComputeFields(values)
+		for key, value := range computed {
+			values[key] = value
+		}
+		fields, unresolved := t.ResolvePatterns(values)
+		for key, value := range computed {
+			fields[key] = value
+		}
+		c.JSON(http.StatusOK, gin.H{"fields": fields, "unresolved": unresolved, "errors": errs})
+	})
+
+	r.GET("/transitions", transitionsHandler)
+
+	r.POST("/lookup", func(c *gin.Context) {
+		var req struct {
+			TemplateName string                 `json:"templateName"`
+			Values       map[string]interface{} `json:"values"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.String(http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+		t, err := FindFormTemplate(req.TemplateName)
+		if err != nil {
+			c.String(http.StatusNotFound, fmt.Sprintf("Error: %v", err))
+			return
+		}
+		values, _ := t.ConvertKinds(req.Values)
+		options, errs := t.DependentFieldOptions(values)
+		visible, visibleErrs := t.VisibleFields(values)
+		c.JSON(http.StatusOK, gin.H{"visible": visible, "visibleErrors": visibleErrs, "options": options, "errors": errs})
+	})
+
+	r.GET("/admin/templates/lint", func(c *gin.Context) {
+		issues, err := LintStoredTemplates()
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Error loading templates")
+			return
+		}
+		if c.Query("format") == "json" {
+			c.JSON(http.StatusOK, issues)
+			return
+		}
+		data := topNavData()
+		data["issues"] = issues
+		data["errorCount"] = lintErrorCount(issues)
+		c.HTML(http.StatusOK, "lint.html", data)
+	})
+
+	r.GET("/admin/templates", adminTemplatesPage)
+	r.GET("/admin/templates/edit", adminTemplateEditPage)
+	r.GET("/admin/templates/derive", adminTemplateDerivePage)
+	r.POST("/admin/templates/preview", adminTemplatePreview)
+	r.POST("/admin/templates/lint", adminTemplateLint)
+	r.POST("/admin/templates/save", adminTemplateSave)
+
+	r.GET("/admin/migrations", adminMigrationsPage)
+	r.POST("/admin/migrations/apply", adminMigrationsApply)
+
+	r.GET("/admin/drift", adminDriftPage)
+
 	r.GET("/retrieve-json", func(c *gin.Context) {
 		id := c.Query("id")
 		if id == "" {
@@ -124,6 +265,71 @@ func main() {
 		c.JSON(http.StatusOK, data)
 	})
 
+	r.GET("/references", func(c *gin.Context) {
+		id := c.Query("id")
+		if id == "" {
+			c.String(http.StatusBadRequest, "Missing id")
+			return
+		}
+		refs, err := FindReferences(id)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to check references")
+			return
+		}
+		c.JSON(http.StatusOK, refs)
+	})
+
+	r.PATCH("/patch-json", patchHandler)
+	r.DELETE("/delete-json", deleteHandler)
+
+	r.POST("/restore-json", func(c *gin.Context) {
+		// ?key= restores one trash entry, ?id= the last deleted copy of id
+		key := c.Query("key")
+		if key == "" {
+			id := c.Query("id")
+			if id == "" {
+				c.String(http.StatusBadRequest, "Missing key or id")
+				return
+			}
+			var err error
+			if key, err = latestTrashKey(id); err != nil {
+				c.String(http.StatusNotFound, fmt.Sprintf("Failed to restore: %v", err))
+				return
+			}
+		}
+		id, err := RestoreFormData(key)
+		if err != nil {
+			c.String(http.StatusConflict, fmt.Sprintf("Failed to restore: %v", err))
+			return
+		}
+		c.String(http.StatusOK, fmt.Sprintf("Restored: %s", id))
+	})
+
+	r.GET("/trash", trashPage)
+
+	r.GET("/bulk-edit", bulkEditPage)
+	r.POST("/bulk-edit/preview", bulkEditPreview)
+	r.POST("/bulk-edit/apply", bulkEditApply)
+
+	r.GET("/export", exportHandler)
+	r.POST("/import", importHandler)
+
+	r.GET("/bulk", bulkPage)
+	r.POST("/bulk/preview", bulkPreview)
+	r.POST("/bulk/commit", bulkCommit)
+
+	r.GET("/graph", graphHandler)
+	r.GET("/graph/view", graphPage)
+
+	r.GET("/search", searchPage)
+	r.GET("/api/v1/search", searchHandler)
+	r.GET("/api/v1/lookup/:name", lookupHandler)
+
+	r.GET("/compare", compareHandler)
+
+	r.GET("/expiring", expiringPage)
+	r.POST("/expiring/extend", extendHandler)
+
 	r.GET("/list-ds-ids", func(c *gin.Context) {
 		docType := c.Query("type")
 		if docType == "" {
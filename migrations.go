@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// Documents committed from a form record the template they came from in
+// "templateName" and "templateRevision". When a template changes shape, its
+// document carries migrations that upgrade older documents:
+//
+//	"migrations": [
+//	    {"toRevision": 4, "rules": [
+//	        {"op": "rename", "field": "model", "to": "modelName"},
+//	        {"op": "default", "field": "status", "value": "active"},
+//	        {"op": "remove", "field": "obsolete"},
+//	        {"op": "transform", "field": "ttl", "expr": "value * 86400"}
+//	    ]}
+//	]
+//
+// A document at revision r receives every migration with toRevision > r, in
+// order, and is then stamped with the template's current revision. Documents
+// created before revisions were recorded count as revision 0. Documents
+// created before templateName was recorded belong to the template of their
+// type, if only one template creates it; otherwise they are reported as
+// ambiguous and left alone. A transform expression sees the field as "value"
+// and the other fields by name.
+
+// MigrationRule is one change made by a migration.
+type MigrationRule struct {
+	Op    string      `json:"op"` // rename, default, remove or transform
+	Field string      `json:"field"`
+	To    string      `json:"to,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+	Expr  string      `json:"expr,omitempty"`
+}
+
+// Migration upgrades documents to ToRevision of their template.
+type Migration struct {
+	ToRevision int             `json:"toRevision"`
+	Rules      []MigrationRule `json:"rules"`
+}
+
+// FieldChange is a single top level difference between two documents.
+type FieldChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// MigrationResult reports the migration of one document.
+type MigrationResult struct {
+	ID           string        `json:"id"`
+	FromRevision int           `json:"fromRevision"`
+	Changes      []FieldChange `json:"changes"`
+	Applied      bool          `json:"applied"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// parseMigrations reads the "migrations" list of a template document,
+// ordered by toRevision.
+func parseMigrations(common map[string]interface{}) []Migration {
+	raw, ok := common["migrations"]
+	if !ok {
+		return nil
+	}
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return nil
+	}
+	var migrations []Migration
+	if err := json.Unmarshal(encoded, &migrations); err != nil {
+		return nil
+	}
+	sort.SliceStable(migrations, func(i, j int) bool { return migrations[i].ToRevision < migrations[j].ToRevision })
+	return migrations
+}
+
+// documentRevision returns the templateRevision recorded in a document.
+func documentRevision(doc map[string]interface{}) int {
+	switch r := doc["templateRevision"].(type) {
+	case float64:
+		return int(r)
+	case int:
+		return r
+	}
+	return 0
+}
+
+// DiffFields lists the top level fields that differ between before and after.
+func DiffFields(before, after map[string]interface{}) []FieldChange {
+	keys := make(map[string]bool, len(before)+len(after))
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+	names := make([]string, 0, len(keys))
+	for k := range keys {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var changes []FieldChange
+	for _, k := range names {
+		if !reflect.DeepEqual(before[k], after[k]) {
+			changes = append(changes, FieldChange{Field: k, Before: before[k], After: after[k]})
+		}
+	}
+	return changes
+}
+
+// applyRule applies one migration rule to doc in place.
+func applyRule(doc map[string]interface{}, rule MigrationRule) error {
+	switch rule.Op {
+	case "rename":
+		if v, ok := doc[rule.Field]; ok {
+			doc[rule.To] = v
+			delete(doc, rule.Field)
+		}
+	case "default":
+		if v, ok := doc[rule.Field]; !ok || v == nil || v == "" {
+			doc[rule.Field] = rule.Value
+		}
+	case "remove":
+		delete(doc, rule.Field)
+	case "transform":
+		env := make(map[string]interface{}, len(doc)+1)
+		for k, v := range doc {
+			env[k] = v
+		}
+		env["value"] = doc[rule.Field]
+		result, err := EvaluateExpression(rule.Expr, env)
+		if err != nil {
+			return fmt.Errorf("transform %s: %w", rule.Field, err)
+		}
+		doc[rule.Field] = result
+	default:
+		return fmt.Errorf("unknown migration op %q", rule.Op)
+	}
+	return nil
+}
+
+// MigrateDocument returns doc upgraded to the current revision of t, or nil
+// when it is already current.
+func (t FormTemplate) MigrateDocument(doc map[string]interface{}) (map[string]interface{}, error) {
+	from := documentRevision(doc)
+	if from >= t.Revision {
+		return nil, nil
+	}
+	out := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		out[k] = v
+	}
+	for _, m := range t.Migrations {
+		if m.ToRevision <= from || m.ToRevision > t.Revision {
+			continue
+		}
+		for _, rule := range m.Rules {
+			if err := applyRule(out, rule); err != nil {
+				return nil, err
+			}
+		}
+	}
+	out["templateName"] = t.TemplateName
+	out["templateRevision"] = t.Revision
+	return out, nil
+}
+
+// templateType returns the constant "type" of t, used to find documents that
+// were created before templateName was recorded.
+func (t FormTemplate) templateType() string {
+	if t.DisabledFields["type"] {
+		s, _ := t.Fields["type"].(string)
+		return s
+	}
+	return ""
+}
+
+// templatesByType maps each document type to the template creating it, for
+// documents created before templateName was recorded. A type created by
+// several templates maps to none: its legacy documents are ambiguous.
+func templatesByType(templates []FormTemplate) map[string]FormTemplate {
+	byType := make(map[string]FormTemplate)
+	shared := make(map[string]bool)
+	for _, t := range templates {
+		docType := t.templateType()
+		if docType == "" || shared[docType] {
+			continue
+		}
+		if _, ok := byType[docType]; ok {
+			delete(byType, docType)
+			shared[docType] = true
+			continue
+		}
+		byType[docType] = t
+	}
+	return byType
+}
+
+// ownsLegacyDocuments reports whether documents of t's type without a
+// templateName are taken to be created from t, that is whether t is the
+// only one of templates creating that type.
+func (t FormTemplate) ownsLegacyDocuments(templates []FormTemplate) bool {
+	owner, ok := templatesByType(templates)[t.templateType()]
+	return ok && owner.TemplateName == t.TemplateName
+}
+
+// ambiguousMessage explains why a legacy document is left alone.
+func (t FormTemplate) ambiguousMessage() string {
+	return fmt.Sprintf("no templateName, and type %s is created by more than one template", t.templateType())
+}
+
+// templateDocumentRows returns the RUNTIME documents created from t, with
+// the columns given, followed by the ambiguous ones: documents of t's type
+// without a templateName when other templates create that type as well.
+func templateDocumentRows(t FormTemplate, templates []FormTemplate, columns string) ([]map[string]interface{}, []map[string]interface{}, error) {
+	cluster := GetConnection(GetCBCredentials())
+	query := "SELECT " + columns + ", r.templateName IS MISSING AS legacyDocument FROM vxdata._default.RUNTIME r" +
+		" WHERE r.templateName = $name OR (r.templateName IS MISSING AND r.type = $type AND $type != '') ORDER BY meta(r).id"
+	result, err := cluster.Query(query, &gocb.QueryOptions{
+		NamedParameters: map[string]interface{}{"name": t.TemplateName, "type": t.templateType()},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	owned := t.ownsLegacyDocuments(templates)
+	var rows, ambiguous []map[string]interface{}
+	for result.Next() {
+		var row map[string]interface{}
+		if err := result.Row(&row); err != nil {
+			continue
+		}
+		legacy, _ := row["legacyDocument"].(bool)
+		delete(row, "legacyDocument")
+		if legacy && !owned {
+			ambiguous = append(ambiguous, row)
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, ambiguous, nil
+}
+
+// TemplateDocumentIDs returns the ids of the RUNTIME documents created from
+// t, and those of the ambiguous legacy documents of its type. templates are
+// all the templates, to tell whether t is the only one creating its type.
+func TemplateDocumentIDs(t FormTemplate, templates []FormTemplate) ([]string, []string, error) {
+	rows, ambiguousRows, err := templateDocumentRows(t, templates, "meta(r).id AS docId")
+	if err != nil {
+		return nil, nil, err
+	}
+	var ids, ambiguous []string
+	for _, row := range rows {
+		id, _ := row["docId"].(string)
+		ids = append(ids, id)
+	}
+	for _, row := range ambiguousRows {
+		id, _ := row["docId"].(string)
+		ambiguous = append(ambiguous, id)
+	}
+	return ids, ambiguous, nil
+}
+
+// TemplateDocuments returns the RUNTIME documents created from t, each with
+// its id in "docId", and the ids of the ambiguous legacy documents of its
+// type.
+func TemplateDocuments(t FormTemplate, templates []FormTemplate) ([]map[string]interface{}, []string, error) {
+	docs, ambiguousRows, err := templateDocumentRows(t, templates, "meta(r).id AS docId, r.*")
+	if err != nil {
+		return nil, nil, err
+	}
+	var ambiguous []string
+	for _, row := range ambiguousRows {
+		id, _ := row["docId"].(string)
+		ambiguous = append(ambiguous, id)
+	}
+	return docs, ambiguous, nil
+}
+
+// RunMigrations migrates every document created from t. With apply false it
+// only reports what would change; with apply true each document is replaced
+// using its CAS, so a document edited in the meantime is reported as failed
+// rather than overwritten.
+func RunMigrations(t FormTemplate, apply bool) ([]MigrationResult, error) {
+	templates, err := GetFormTemplates()
+	if err != nil {
+		return nil, err
+	}
+	ids, ambiguous, err := TemplateDocumentIDs(t, templates)
+	if err != nil {
+		return nil, err
+	}
+	collection := runtimeCollection()
+	var results []MigrationResult
+	for _, id := range ambiguous {
+		results = append(results, MigrationResult{ID: id, Error: t.ambiguousMessage()})
+	}
+	for _, id := range ids {
+		getResult, err := collection.Get(id, &gocb.GetOptions{})
+		if err != nil {
+			results = append(results, MigrationResult{ID: id, Error: err.Error()})
+			continue
+		}
+		var doc map[string]interface{}
+		if err := getResult.Content(&doc); err != nil {
+			results = append(results, MigrationResult{ID: id, Error: err.Error()})
+			continue
+		}
+		migrated, err := t.MigrateDocument(doc)
+		result := MigrationResult{ID: id, FromRevision: documentRevision(doc)}
+		if err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+		if migrated == nil {
+			continue
+		}
+		result.Changes = DiffFields(doc, migrated)
+		if apply {
+			if _, err := collection.Replace(id, migrated, &gocb.ReplaceOptions{Cas: getResult.Cas(), PreserveExpiry: true}); err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Applied = true
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// adminMigrationsPage previews the migrations of ?template=<name>.
+func adminMigrationsPage(c *gin.Context) {
+	data := topNavData()
+	templates, err := GetFormTemplates()
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Error loading forms")
+		return
+	}
+	data["forms"] = templates
+	if name := c.Query("template"); name != "" {
+		t, err := FindFormTemplate(name)
+		if err != nil {
+			c.String(http.StatusNotFound, "Not found")
+			return
+		}
+		results, err := RunMigrations(t, false)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Error loading documents")
+			return
+		}
+		data["selected"] = t
+		data["results"] = results
+	}
+	c.HTML(http.StatusOK, "migrations.html", data)
+}
+
+// adminMigrationsApply applies the migrations of {"template": <name>} and
+// returns the per-document results.
+func adminMigrationsApply(c *gin.Context) {
+	var req struct {
+		Template string `json:"template"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.String(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	t, err := FindFormTemplate(req.Template)
+	if err != nil {
+		c.String(http.StatusNotFound, "Not found")
+		return
+	}
+	results, err := RunMigrations(t, true)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Error loading documents")
+		return
+	}
+	c.JSON(http.StatusOK, results)
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func typedTemplate(name, docType string) FormTemplate {
+	return FormTemplate{
+		TemplateName:   name,
+		Fields:         map[string]interface{}{"type": docType},
+		DisabledFields: map[string]bool{"type": true},
+	}
+}
+
+func TestTemplatesByType(t *testing.T) {
+	templates := []FormTemplate{
+		typedTemplate("DS_TEMPLATE", "DS"),
+		typedTemplate("PS_TEMPLATE", "PS"),
+		typedTemplate("PS_OBS_TEMPLATE", "PS"),
+		typedTemplate("PS_MODEL_TEMPLATE", "PS"),
+		{TemplateName: "FREE_TEMPLATE", Fields: map[string]interface{}{"type": "XX"}, DisabledFields: map[string]bool{}},
+	}
+	byType := templatesByType(templates)
+	if got := byType["DS"].TemplateName; got != "DS_TEMPLATE" {
+		t.Errorf("DS maps to %q, want DS_TEMPLATE", got)
+	}
+	if got, ok := byType["PS"]; ok {
+		t.Errorf("PS is shared by three templates but maps to %q", got.TemplateName)
+	}
+	if _, ok := byType["XX"]; ok {
+		t.Errorf("a template without a constant type maps its type")
+	}
+	if !templates[0].ownsLegacyDocuments(templates) {
+		t.Errorf("DS_TEMPLATE should own the legacy DS documents")
+	}
+	if templates[1].ownsLegacyDocuments(templates) {
+		t.Errorf("PS_TEMPLATE should not own the legacy PS documents")
+	}
+}
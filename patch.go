@@ -0,0 +1,607 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// Partial updates of RUNTIME documents. A JSON Patch (RFC 6902) or merge
+// patch (RFC 7396) is checked against the current document, then sent as
+// sub-document mutations with the CAS of the document that was checked, so
+// a concurrent change makes the patch fail instead of being overwritten.
+
+// maxPatchSpecs is the number of sub-document mutations Couchbase allows in
+// one MutateIn.
+const maxPatchSpecs = 16
+
+var (
+	// errInvalidPatch is returned for a patch that cannot be applied to the
+	// document.
+	errInvalidPatch = errors.New("invalid patch")
+	// errPatchTest is returned when a JSON Patch "test" operation fails.
+	errPatchTest = errors.New("test failed")
+)
+
+// PatchOperation is one RFC 6902 operation. Value is kept raw so that a
+// missing value can be told from an explicit null.
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// value decodes the value of an add, replace or test operation, which must
+// have one.
+func (op PatchOperation) value() (interface{}, error) {
+	if len(op.Value) == 0 {
+		return nil, errors.New("missing value")
+	}
+	var v interface{}
+	if err := json.Unmarshal(op.Value, &v); err != nil {
+		return nil, fmt.Errorf("invalid value: %w", err)
+	}
+	return v, nil
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into its unescaped tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index token; "-" (past the end) is only
+// allowed when end is set.
+func arrayIndex(token string, length int, end bool) (int, error) {
+	if token == "-" && end {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if i > length || (i == length && !end) {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+// subdocPath converts pointer tokens into a sub-document path such as
+// `ingest.models[2]`, resolving numeric tokens against doc. Keys that
+// contain path syntax are quoted with backticks.
+func subdocPath(doc interface{}, tokens []string) (string, error) {
+	var sb strings.Builder
+	current := doc
+	for n, token := range tokens {
+		switch c := current.(type) {
+		case []interface{}:
+			i, err := arrayIndex(token, len(c), n == len(tokens)-1)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&sb, "[%d]", i)
+			if i < len(c) {
+				current = c[i]
+			} else {
+				current = nil
+			}
+		case map[string]interface{}:
+			if sb.Len() > 0 {
+				sb.WriteByte('.')
+			}
+			if strings.ContainsAny(token, ".[]`") {
+				sb.WriteString("`" + strings.ReplaceAll(token, "`", "``") + "`")
+			} else {
+				sb.WriteString(token)
+			}
+			current = c[token]
+		default:
+			return "", fmt.Errorf("%s is not inside an object or array", "/"+strings.Join(tokens[:n+1], "/"))
+		}
+	}
+	return sb.String(), nil
+}
+
+// pointerValue returns the value at tokens in doc.
+func pointerValue(doc interface{}, tokens []string) (interface{}, bool) {
+	current := doc
+	for _, token := range tokens {
+		switch c := current.(type) {
+		case map[string]interface{}:
+			v, ok := c[token]
+			if !ok {
+				return nil, false
+			}
+			current = v
+		case []interface{}:
+			i, err := arrayIndex(token, len(c), false)
+			if err != nil {
+				return nil, false
+			}
+			current = c[i]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// setPointer applies add (insert into arrays) or replace (which must exist)
+// at tokens, returning the updated container.
+func setPointer(doc interface{}, tokens []string, value interface{}, replace bool) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	token, rest := tokens[0], tokens[1:]
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		child, ok := c[token]
+		if len(rest) == 0 {
+			if replace && !ok {
+				return nil, fmt.Errorf("%s does not exist", token)
+			}
+			c[token] = value
+			return c, nil
+		}
+		if !ok {
+			return nil, fmt.Errorf("%s does not exist", token)
+		}
+		updated, err := setPointer(child, rest, value, replace)
+		if err != nil {
+			return nil, err
+		}
+		c[token] = updated
+		return c, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(c), len(rest) == 0 && !replace)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 {
+			if replace {
+				c[i] = value
+				return c, nil
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		}
+		updated, err := setPointer(c[i], rest, value, replace)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = updated
+		return c, nil
+	}
+	return nil, fmt.Errorf("%s is not inside an object or array", token)
+}
+
+// removePointer removes the value at tokens, returning the updated container.
+func removePointer(doc interface{}, tokens []string) (interface{}, error) {
+	token, rest := tokens[0], tokens[1:]
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		child, ok := c[token]
+		if !ok {
+			return nil, fmt.Errorf("%s does not exist", token)
+		}
+		if len(rest) == 0 {
+			delete(c, token)
+			return c, nil
+		}
+		updated, err := removePointer(child, rest)
+		if err != nil {
+			return nil, err
+		}
+		c[token] = updated
+		return c, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(c), false)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 {
+			return append(c[:i], c[i+1:]...), nil
+		}
+		updated, err := removePointer(c[i], rest)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = updated
+		return c, nil
+	}
+	return nil, fmt.Errorf("%s is not inside an object or array", token)
+}
+
+// deepCopy copies a decoded JSON value.
+func deepCopy(v interface{}) interface{} {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(c))
+		for k, v := range c {
+			out[k] = deepCopy(v)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(c))
+		for i, v := range c {
+			out[i] = deepCopy(v)
+		}
+		return out
+	}
+	return v
+}
+
+// protectedFields cannot be patched: the id must keep matching the document
+// key, and the statusHistory is only appended to by status changes.
+var protectedFields = []string{"id", "statusHistory"}
+
+// protectedPath reports whether tokens touch the whole document or one of
+// the protectedFields.
+func protectedPath(tokens []string) bool {
+	return len(tokens) == 0 || containsString(protectedFields, tokens[0])
+}
+
+// addSpec returns the mutation that adds value at tokens of doc (before the
+// add), and the updated document.
+func addSpec(doc map[string]interface{}, tokens []string, value interface{}) (gocb.MutateInSpec, map[string]interface{}, error) {
+	path, err := subdocPath(doc, tokens)
+	if err != nil {
+		return gocb.MutateInSpec{}, nil, err
+	}
+	parent, _ := pointerValue(doc, tokens[:len(tokens)-1])
+	var spec gocb.MutateInSpec
+	if arr, ok := parent.([]interface{}); ok {
+		if tokens[len(tokens)-1] == "-" || tokens[len(tokens)-1] == strconv.Itoa(len(arr)) {
+			spec = gocb.ArrayAppendSpec(path[:strings.LastIndex(path, "[")], value, nil)
+		} else {
+			spec = gocb.ArrayInsertSpec(path, value, nil)
+		}
+	} else {
+		spec = gocb.UpsertSpec(path, value, nil)
+	}
+	updated, err := setPointer(doc, tokens, deepCopy(value), false)
+	if err != nil {
+		return gocb.MutateInSpec{}, nil, err
+	}
+	return spec, updated.(map[string]interface{}), nil
+}
+
+// JSONPatchSpecs translates a JSON Patch into sub-document mutations against
+// doc, and returns the patched document. doc itself is not changed.
+func JSONPatchSpecs(doc map[string]interface{}, ops []PatchOperation) ([]gocb.MutateInSpec, map[string]interface{}, error) {
+	current := deepCopy(doc).(map[string]interface{})
+	var specs []gocb.MutateInSpec
+	for n, op := range ops {
+		fail := func(err error) ([]gocb.MutateInSpec, map[string]interface{}, error) {
+			return nil, nil, fmt.Errorf("operation %d (%s %s): %w", n, op.Op, op.Path, err)
+		}
+		tokens, err := parsePointer(op.Path)
+		if err != nil {
+			return fail(err)
+		}
+		if op.Op != "test" && protectedPath(tokens) {
+			return fail(errors.New("the id, the statusHistory and the whole document cannot be patched"))
+		}
+		var value interface{}
+		switch op.Op {
+		case "test", "add", "replace":
+			if value, err = op.value(); err != nil {
+				return fail(err)
+			}
+		}
+		switch op.Op {
+		case "test":
+			v, ok := pointerValue(current, tokens)
+			if !ok || !reflect.DeepEqual(v, value) {
+				return fail(errPatchTest)
+			}
+		case "add":
+			spec, updated, err := addSpec(current, tokens, value)
+			if err != nil {
+				return fail(err)
+			}
+			specs, current = append(specs, spec), updated
+		case "replace":
+			path, err := subdocPath(current, tokens)
+			if err != nil {
+				return fail(err)
+			}
+			updated, err := setPointer(current, tokens, deepCopy(value), true)
+			if err != nil {
+				return fail(err)
+			}
+			specs, current = append(specs, gocb.ReplaceSpec(path, value, nil)), updated.(map[string]interface{})
+		case "remove":
+			path, err := subdocPath(current, tokens)
+			if err != nil {
+				return fail(err)
+			}
+			updated, err := removePointer(current, tokens)
+			if err != nil {
+				return fail(err)
+			}
+			specs, current = append(specs, gocb.RemoveSpec(path, nil)), updated.(map[string]interface{})
+		case "copy", "move":
+			from, err := parsePointer(op.From)
+			if err != nil {
+				return fail(err)
+			}
+			value, ok := pointerValue(current, from)
+			if !ok {
+				return fail(fmt.Errorf("%s does not exist", op.From))
+			}
+			value = deepCopy(value)
+			if op.Op == "move" {
+				if protectedPath(from) {
+					return fail(errors.New("the id and the statusHistory cannot be moved"))
+				}
+				if op.From == op.Path {
+					// moving a value onto itself leaves it where it is
+					continue
+				}
+				if strings.HasPrefix(op.Path+"/", op.From+"/") {
+					return fail(errors.New("cannot move a value into itself"))
+				}
+				path, err := subdocPath(current, from)
+				if err != nil {
+					return fail(err)
+				}
+				updated, err := removePointer(current, from)
+				if err != nil {
+					return fail(err)
+				}
+				specs, current = append(specs, gocb.RemoveSpec(path, nil)), updated.(map[string]interface{})
+			}
+			spec, updated, err := addSpec(current, tokens, value)
+			if err != nil {
+				return fail(err)
+			}
+			specs, current = append(specs, spec), updated
+		default:
+			return fail(errors.New("unknown operation"))
+		}
+	}
+	return specs, current, nil
+}
+
+// MergePatchSpecs translates a merge patch into sub-document mutations
+// against doc, and returns the patched document. doc itself is not changed.
+func MergePatchSpecs(doc map[string]interface{}, patch map[string]interface{}) ([]gocb.MutateInSpec, map[string]interface{}, error) {
+	for _, key := range protectedFields {
+		if _, ok := patch[key]; ok {
+			return nil, nil, fmt.Errorf("%s cannot be patched", key)
+		}
+	}
+	current := deepCopy(doc).(map[string]interface{})
+	var specs []gocb.MutateInSpec
+	var merge func(target map[string]interface{}, patch map[string]interface{}, tokens []string) error
+	merge = func(target map[string]interface{}, patch map[string]interface{}, tokens []string) error {
+		keys := make([]string, 0, len(patch))
+		for k := range patch {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := patch[k]
+			child := append(append([]string{}, tokens...), k)
+			path, err := subdocPath(current, child)
+			if err != nil {
+				return err
+			}
+			existing, exists := target[k]
+			if v == nil {
+				if exists {
+					specs = append(specs, gocb.RemoveSpec(path, nil))
+					delete(target, k)
+				}
+				continue
+			}
+			sub, isObject := v.(map[string]interface{})
+			existingObject, targetIsObject := existing.(map[string]interface{})
+			if isObject && targetIsObject {
+				if err := merge(existingObject, sub, child); err != nil {
+					return err
+				}
+				continue
+			}
+			// RFC 7396: null members of a new object are dropped
+			value := mergeNew(v)
+			specs = append(specs, gocb.UpsertSpec(path, value, nil))
+			target[k] = deepCopy(value)
+		}
+		return nil
+	}
+	if err := merge(current, patch, nil); err != nil {
+		return nil, nil, err
+	}
+	return specs, current, nil
+}
+
+// mergeNew is a merge patch value applied where there is no object to merge
+// into: objects lose their null members.
+func mergeNew(v interface{}) interface{} {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return v
+	}
+	out := make(map[string]interface{}, len(obj))
+	for k, child := range obj {
+		if child != nil {
+			out[k] = mergeNew(child)
+		}
+	}
+	return out
+}
+
+// sameJSON reports whether a and b encode to the same JSON, so that an
+// int64 from a conversion equals the float64 it was decoded as.
+func sameJSON(a, b interface{}) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(ja) == string(jb)
+}
+
+// checkedSpecs returns the mutations that turn the top-level fields of
+// patched into those of checked, the document as a commit would store it:
+// recomputed and converted values are set, and fields it drops removed.
+func checkedSpecs(patched, checked map[string]interface{}) ([]gocb.MutateInSpec, error) {
+	if !sameJSON(patched["id"], checked["id"]) {
+		return nil, errors.New("the change would resolve a different id")
+	}
+	keys := make([]string, 0, len(patched)+len(checked))
+	for key := range patched {
+		keys = append(keys, key)
+	}
+	for key := range checked {
+		if _, ok := patched[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var specs []gocb.MutateInSpec
+	for _, key := range keys {
+		before, had := patched[key]
+		after, has := checked[key]
+		if had == has && sameJSON(before, after) {
+			continue
+		}
+		path, err := subdocPath(patched, []string{key})
+		if err != nil {
+			return nil, err
+		}
+		if has {
+			specs = append(specs, gocb.UpsertSpec(path, after, nil))
+		} else {
+			specs = append(specs, gocb.RemoveSpec(path, nil))
+		}
+	}
+	return specs, nil
+}
+
+// PatchFormData applies a JSON Patch (merge false) or merge patch to a
+// RUNTIME document, returning the patched document. A document with a
+// template is checked as a commit would check it, and the fields a commit
+// would recompute are patched along.
+func PatchFormData(id string, body []byte, merge bool) (map[string]interface{}, error) {
+	cluster := GetConnection(GetCBCredentials())
+	defer cluster.Close(nil)
+	collection := cluster.Bucket(GetCBCredentials().CBBucket).Collection("RUNTIME")
+	getResult, err := collection.Get(id, &gocb.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve data: %w", err)
+	}
+	var doc map[string]interface{}
+	if err := getResult.Content(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode content: %w", err)
+	}
+	var specs []gocb.MutateInSpec
+	var patched map[string]interface{}
+	if merge {
+		var patch map[string]interface{}
+		if err := json.Unmarshal(body, &patch); err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidPatch, err)
+		}
+		specs, patched, err = MergePatchSpecs(doc, patch)
+	} else {
+		var ops []PatchOperation
+		if err := json.Unmarshal(body, &ops); err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidPatch, err)
+		}
+		specs, patched, err = JSONPatchSpecs(doc, ops)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidPatch, err)
+	}
+	templates, err := GetFormTemplates()
+	if err != nil {
+		return nil, err
+	}
+	opts := &gocb.MutateInOptions{Cas: getResult.Cas(), PreserveExpiry: true}
+	if t, ok := templateForDocument(templates, doc); ok {
+		checked, err := t.checkDocument(cluster, patched)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidPatch, err)
+		}
+		extra, err := checkedSpecs(patched, checked)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidPatch, err)
+		}
+		specs, patched = append(specs, extra...), checked
+		if t.tierChanged(doc, patched) {
+			if opts.Expiry, _, err = t.DocumentExpiry(patched); err != nil {
+				return nil, fmt.Errorf("%w: %w", errInvalidPatch, err)
+			}
+			opts.PreserveExpiry = false
+		}
+		changes, err := t.StatusChanges(doc, patched, "patch")
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidPatch, err)
+		}
+		for _, ch := range changes {
+			specs = append(specs, gocb.ArrayAppendSpec("statusHistory", ch, &gocb.ArrayAppendSpecOptions{CreatePath: true}))
+		}
+		patched = withStatusHistory(patched, doc, changes)
+	}
+	if len(specs) == 0 {
+		return patched, nil
+	}
+	if len(specs) > maxPatchSpecs {
+		return nil, fmt.Errorf("%w: it makes %d changes, at most %d are allowed", errInvalidPatch, len(specs), maxPatchSpecs)
+	}
+	if _, err := collection.MutateIn(id, specs, opts); err != nil {
+		return nil, fmt.Errorf("failed to patch data: %w", err)
+	}
+	return patched, nil
+}
+
+// patchHandler patches ?id=<id> with the request body: a merge patch when
+// the Content-Type is application/merge-patch+json, a JSON Patch otherwise.
+func patchHandler(c *gin.Context) {
+	id := c.Query("id")
+	if id == "" {
+		c.String(http.StatusBadRequest, "Missing id")
+		return
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Cannot read body")
+		return
+	}
+	merge := strings.HasPrefix(c.ContentType(), "application/merge-patch+json")
+	patched, err := PatchFormData(id, body, merge)
+	switch {
+	case errors.Is(err, gocb.ErrDocumentNotFound):
+		c.String(http.StatusNotFound, "Not found")
+	case errors.Is(err, gocb.ErrCasMismatch):
+		c.String(http.StatusConflict, "The document changed while it was being patched; retry")
+	case errors.Is(err, errPatchTest):
+		c.String(http.StatusConflict, fmt.Sprintf("Error: %v", err))
+	case errors.Is(err, errInvalidPatch):
+		c.String(http.StatusUnprocessableEntity, fmt.Sprintf("Error: %v", err))
+	case err != nil:
+		c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to patch: %v", err))
+	default:
+		c.JSON(http.StatusOK, patched)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// patchTestDocument returns a fresh document for each test case.
+func patchTestDocument() map[string]interface{} {
+	var doc map[string]interface{}
+	json.Unmarshal([]byte(`{
+		"id": "DS:HRRR",
+		"type": "DS",
+		"status": "active",
+		"note": null,
+		"models": ["HRRR", "RAP"],
+		"ingest": {"region": "CONUS", "fcstLen": 18}
+	}`), &doc)
+	return doc
+}
+
+func decodeJSON(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("invalid test JSON %s: %v", s, err)
+	}
+	return v
+}
+
+func TestJSONPatchSpecs(t *testing.T) {
+	tests := []struct {
+		name  string
+		patch string
+		specs int
+		want  string // the changed members of the document, over patchTestDocument
+		err   error  // when set, the patch must fail with this error
+		fails bool
+	}{
+		{name: "add a field", patch: `[{"op":"add","path":"/region","value":"CONUS"}]`, specs: 1, want: `{"region":"CONUS"}`},
+		{name: "add null", patch: `[{"op":"add","path":"/region","value":null}]`, specs: 1, want: `{"region":null}`},
+		{name: "add into an array", patch: `[{"op":"add","path":"/models/1","value":"GFS"}]`, specs: 1, want: `{"models":["HRRR","GFS","RAP"]}`},
+		{name: "append to an array", patch: `[{"op":"add","path":"/models/-","value":"GFS"}]`, specs: 1, want: `{"models":["HRRR","RAP","GFS"]}`},
+		{name: "replace a nested field", patch: `[{"op":"replace","path":"/ingest/fcstLen","value":24}]`, specs: 1, want: `{"ingest":{"region":"CONUS","fcstLen":24}}`},
+		{name: "remove a field", patch: `[{"op":"remove","path":"/status"}]`, specs: 1, want: `{"status":"<removed>"}`},
+		{name: "copy", patch: `[{"op":"copy","from":"/ingest/region","path":"/region"}]`, specs: 1, want: `{"region":"CONUS"}`},
+		{name: "move", patch: `[{"op":"move","from":"/status","path":"/state"}]`, specs: 2, want: `{"status":"<removed>","state":"active"}`},
+		{name: "move onto itself", patch: `[{"op":"move","from":"/status","path":"/status"}]`, specs: 0, want: `{}`},
+		{name: "test then replace", patch: `[{"op":"test","path":"/status","value":"active"},{"op":"replace","path":"/status","value":"retired"}]`, specs: 1, want: `{"status":"retired"}`},
+		{name: "test null", patch: `[{"op":"test","path":"/note","value":null}]`, specs: 0, want: `{}`},
+		{name: "failed test", patch: `[{"op":"test","path":"/status","value":"retired"}]`, err: errPatchTest},
+		{name: "test without a value", patch: `[{"op":"test","path":"/note"}]`, fails: true},
+		{name: "add without a value", patch: `[{"op":"add","path":"/region"}]`, fails: true},
+		{name: "replace without a value", patch: `[{"op":"replace","path":"/status"}]`, fails: true},
+		{name: "replace a missing field", patch: `[{"op":"replace","path":"/region","value":"CONUS"}]`, fails: true},
+		{name: "remove a missing field", patch: `[{"op":"remove","path":"/region"}]`, fails: true},
+		{name: "patch the id", patch: `[{"op":"replace","path":"/id","value":"DS:RAP"}]`, fails: true},
+		{name: "replace the document", patch: `[{"op":"replace","path":"","value":{}}]`, fails: true},
+		{name: "move the id", patch: `[{"op":"move","from":"/id","path":"/oldId"}]`, fails: true},
+		{name: "rewrite the status history", patch: `[{"op":"add","path":"/statusHistory","value":[]}]`, fails: true},
+		{name: "copy over the status history", patch: `[{"op":"copy","from":"/models","path":"/statusHistory"}]`, fails: true},
+		{name: "move into itself", patch: `[{"op":"move","from":"/ingest","path":"/ingest/inner"}]`, fails: true},
+		{name: "index out of range", patch: `[{"op":"add","path":"/models/5","value":"GFS"}]`, fails: true},
+		{name: "unknown operation", patch: `[{"op":"rename","path":"/status"}]`, fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ops []PatchOperation
+			if err := json.Unmarshal([]byte(tt.patch), &ops); err != nil {
+				t.Fatalf("invalid test patch: %v", err)
+			}
+			doc := patchTestDocument()
+			specs, patched, err := JSONPatchSpecs(doc, ops)
+			if tt.err != nil || tt.fails {
+				if err == nil {
+					t.Fatalf("JSONPatchSpecs succeeded, want an error")
+				}
+				if tt.err != nil && !errors.Is(err, tt.err) {
+					t.Errorf("JSONPatchSpecs failed with %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("JSONPatchSpecs failed: %v", err)
+			}
+			if len(specs) != tt.specs {
+				t.Errorf("got %d mutations, want %d", len(specs), tt.specs)
+			}
+			want := patchTestDocument()
+			for k, v := range decodeJSON(t, tt.want) {
+				if v == "<removed>" {
+					delete(want, k)
+				} else {
+					want[k] = v
+				}
+			}
+			if !reflect.DeepEqual(patched, want) {
+				t.Errorf("patched document is %v, want %v", patched, want)
+			}
+			if !reflect.DeepEqual(doc, patchTestDocument()) {
+				t.Errorf("the original document was changed to %v", doc)
+			}
+		})
+	}
+}
+
+func TestMergePatchSpecs(t *testing.T) {
+	tests := []struct {
+		name  string
+		patch string
+		specs int
+		want  string
+		fails bool
+	}{
+		{name: "set a field", patch: `{"status":"retired"}`, specs: 1, want: `{"status":"retired"}`},
+		{name: "remove a field", patch: `{"status":null}`, specs: 1, want: `{"status":"<removed>"}`},
+		{name: "remove a missing field", patch: `{"region":null}`, specs: 0, want: `{}`},
+		{name: "merge into an object", patch: `{"ingest":{"fcstLen":24,"region":null}}`, specs: 2, want: `{"ingest":{"fcstLen":24}}`},
+		{name: "new object drops nulls", patch: `{"options":{"a":1,"b":null}}`, specs: 1, want: `{"options":{"a":1}}`},
+		{name: "replace an array", patch: `{"models":["GFS"]}`, specs: 1, want: `{"models":["GFS"]}`},
+		{name: "object replaces a value", patch: `{"status":{"value":"active"}}`, specs: 1, want: `{"status":{"value":"active"}}`},
+		{name: "empty patch", patch: `{}`, specs: 0, want: `{}`},
+		{name: "patch the id", patch: `{"id":"DS:RAP"}`, fails: true},
+		{name: "remove the status history", patch: `{"statusHistory":null}`, fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := patchTestDocument()
+			specs, patched, err := MergePatchSpecs(doc, decodeJSON(t, tt.patch))
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("MergePatchSpecs succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergePatchSpecs failed: %v", err)
+			}
+			if len(specs) != tt.specs {
+				t.Errorf("got %d mutations, want %d", len(specs), tt.specs)
+			}
+			want := patchTestDocument()
+			for k, v := range decodeJSON(t, tt.want) {
+				if v == "<removed>" {
+					delete(want, k)
+				} else {
+					want[k] = v
+				}
+			}
+			if !reflect.DeepEqual(patched, want) {
+				t.Errorf("patched document is %v, want %v", patched, want)
+			}
+			if !reflect.DeepEqual(doc, patchTestDocument()) {
+				t.Errorf("the original document was changed to %v", doc)
+			}
+		})
+	}
+}
+
+func TestCheckedSpecs(t *testing.T) {
+	tests := []struct {
+		name    string
+		checked string // changed members of the checked document, over patchTestDocument
+		specs   int
+		fails   bool
+	}{
+		{name: "nothing to recompute", checked: `{}`, specs: 0},
+		{name: "a recomputed field", checked: `{"fcstHours":18}`, specs: 1},
+		{name: "a converted field", checked: `{"ingest":{"region":"CONUS","fcstLen":18.5}}`, specs: 1},
+		{name: "a hidden field", checked: `{"note":"<removed>"}`, specs: 1},
+		{name: "a different id", checked: `{"id":"DS:RAP"}`, fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checked := patchTestDocument()
+			for k, v := range decodeJSON(t, tt.checked) {
+				if v == "<removed>" {
+					delete(checked, k)
+				} else {
+					checked[k] = v
+				}
+			}
+			specs, err := checkedSpecs(patchTestDocument(), checked)
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("checkedSpecs succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("checkedSpecs failed: %v", err)
+			}
+			if len(specs) != tt.specs {
+				t.Errorf("got %d mutations, want %d", len(specs), tt.specs)
+			}
+		})
+	}
+}
+
+func TestCheckedSpecsConvertsKinds(t *testing.T) {
+	tmpl := FormTemplate{Kinds: map[string]string{"fcstLen": KindDuration, "validFrom": KindEpoch}}
+	patched := decodeJSON(t, `{"id":"DS:HRRR","fcstLen":"1h","validFrom":1700000000}`)
+	checked, err := tmpl.resolveFields(patched)
+	if err != nil {
+		t.Fatalf("resolveFields failed: %v", err)
+	}
+	specs, err := checkedSpecs(patched, checked)
+	if err != nil {
+		t.Fatalf("checkedSpecs failed: %v", err)
+	}
+	// the stored epoch is already in seconds, only the duration changes
+	if len(specs) != 1 {
+		t.Errorf("got %d mutations, want 1", len(specs))
+	}
+}
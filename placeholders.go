@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Placeholder is a single "*name" (or "*{name}") reference found in a string.
+// Start and End are byte offsets of the whole expression, including the '*'.
+type Placeholder struct {
+	Name  string
+	Start int
+	End   int
+}
+
+func isPlaceholderChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// ParsePlaceholders returns every placeholder expression in s, in order.
+// A placeholder is a '*' followed either by a run of letters, digits and
+// underscores, or by a name wrapped in braces. A lone '*' (e.g. "SELECT *")
+// is not a placeholder.
+func ParsePlaceholders(s string) []Placeholder {
+	var placeholders []Placeholder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '*' || i+1 >= len(s) {
+			continue
+		}
+		if s[i+1] == '{' {
+			end := strings.IndexByte(s[i+2:], '}')
+			if end <= 0 {
+				continue
+			}
+			placeholders = append(placeholders, Placeholder{Name: s[i+2 : i+2+end], Start: i, End: i + 3 + end})
+			i += 2 + end
+			continue
+		}
+		j := i + 1
+		for j < len(s) && isPlaceholderChar(s[j]) {
+			j++
+		}
+		if j == i+1 {
+			continue
+		}
+		placeholders = append(placeholders, Placeholder{Name: s[i+1 : j], Start: i, End: j})
+		i = j - 1
+	}
+	return placeholders
+}
+
+// PlaceholderResolver substitutes placeholders from a set of field values.
+// Only placeholders whose name is in Fields are touched; anything else (for
+// example the "*stationName" variables that vxIngest resolves at ingest time)
+// is left exactly as written.
+type PlaceholderResolver struct {
+	Fields map[string]bool
+	Values map[string]interface{}
+}
+
+// NewPlaceholderResolver returns a resolver for the fields of t using the
+// submitted values.
+func NewPlaceholderResolver(t FormTemplate, values map[string]interface{}) PlaceholderResolver {
+	fields := make(map[string]bool, len(t.Fields))
+	for key := range t.Fields {
+		fields[strings.TrimPrefix(key, "@")] = true
+	}
+	return PlaceholderResolver{Fields: fields, Values: values}
+}
+
+// lookup returns the substitution text for name, or false if the field has
+// no usable value yet (missing, empty, or itself still a placeholder).
+func (r PlaceholderResolver) lookup(name string) (string, bool) {
+	v, ok := r.Values[name]
+	if !ok || v == nil {
+		return "", false
+	}
+	var s string
+	switch val := v.(type) {
+	case string:
+		s = val
+	case []interface{}:
+		if len(val) != 1 {
+			return "", false
+		}
+		s = fmt.Sprintf("%v", val[0])
+	case []string:
+		if len(val) != 1 {
+			return "", false
+		}
+		s = val[0]
+	case float64:
+		s = strconv.FormatFloat(val, 'f', -1, 64)
+	default:
+		s = fmt.Sprintf("%v", val)
+	}
+	if s == "" || len(ParsePlaceholders(s)) > 0 {
+		return "", false
+	}
+	return s, true
+}
+
+// ResolveString substitutes the known placeholders in s and returns the
+// result together with the names of the known placeholders that could not be
+// resolved.
+func (r PlaceholderResolver) ResolveString(s string) (string, []string) {
+	placeholders := ParsePlaceholders(s)
+	if len(placeholders) == 0 {
+		return s, nil
+	}
+	var b strings.Builder
+	var unresolved []string
+	last := 0
+	for _, p := range placeholders {
+		if !r.Fields[p.Name] {
+			continue
+		}
+		value, ok := r.lookup(p.Name)
+		if !ok {
+			unresolved = append(unresolved, p.Name)
+			continue
+		}
+		b.WriteString(s[last:p.Start])
+		b.WriteString(value)
+		last = p.End
+	}
+	b.WriteString(s[last:])
+	return b.String(), unresolved
+}
+
+// Resolve walks v (a string, map or slice as decoded from JSON) and resolves
+// every string inside it. Map keys are never rewritten.
+func (r PlaceholderResolver) Resolve(v interface{}) (interface{}, []string) {
+	switch val := v.(type) {
+	case string:
+		return r.ResolveString(val)
+	case map[string]interface{}:
+		var unresolved []string
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			resolved, missing := r.Resolve(item)
+			out[k] = resolved
+			unresolved = append(unresolved, missing...)
+		}
+		return out, unresolved
+	case []interface{}:
+		var unresolved []string
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			resolved, missing := r.Resolve(item)
+			out[i] = resolved
+			unresolved = append(unresolved, missing...)
+		}
+		return out, unresolved
+	default:
+		return v, nil
+	}
+}
+
+// uniqueSorted removes duplicates from names and sorts them.
+func uniqueSorted(names []string) []string {
+	if len(names) == 0 {
+		return nil
+	}
+	seen := make(map[string]bool, len(names))
+	out := make([]string, 0, len(names))
+	for _, n := range names {
+		if !seen[n] {
+			seen[n] = true
+			out = append(out, n)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// ResolvePatterns resolves every placeholder pattern of t (the id, constant
+// fields and "@" JSON fields whose template value references other fields)
+// against the submitted values. It returns the resolved value of each pattern
+// field, keyed by document field name, and the unresolved placeholder names
+// for each field that still has some.
+func (t FormTemplate) ResolvePatterns(values map[string]interface{}) (map[string]interface{}, map[string][]string) {
+	resolver := NewPlaceholderResolver(t, values)
+	resolved := make(map[string]interface{}, len(t.Patterns))
+	unresolved := make(map[string][]string)
+	for key, pattern := range t.Patterns {
+		value, missing := resolver.Resolve(pattern)
+		resolved[key] = value
+		if missing = uniqueSorted(missing); len(missing) > 0 {
+			unresolved[key] = missing
+		}
+	}
+	return resolved, unresolved
+}
+
+// ResolveDocument applies the template's patterns to a submitted document.
+// Constant (disabled) pattern fields always take the resolved pattern; other
+// pattern fields keep the submitted value, with any placeholders still in it
+// resolved. Any field whose known placeholders cannot be resolved is reported.
+func (t FormTemplate) ResolveDocument(doc map[string]interface{}) (map[string]interface{}, map[string][]string) {
+	resolver := NewPlaceholderResolver(t, doc)
+	out := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		out[k] = v
+	}
+	unresolved := make(map[string][]string)
+	for key, pattern := range t.Patterns {
+		source := pattern
+		if current, ok := doc[key]; ok && !t.DisabledFields[key] {
+			source = current
+		}
+		value, missing := resolver.Resolve(source)
+		out[key] = value
+		if missing = uniqueSorted(missing); len(missing) > 0 {
+			unresolved[key] = missing
+		}
+	}
+	return out, unresolved
+}
+
+// templatePatterns collects the template values that reference other fields
+// of the template through placeholders. Keys are document field names, so
+// "@template" is stored as "template".
+func templatePatterns(template map[string]interface{}) map[string]interface{} {
+	fields := make(map[string]bool, len(template))
+	for key := range template {
+		fields[strings.TrimPrefix(key, "@")] = true
+	}
+	resolver := PlaceholderResolver{Fields: fields}
+	patterns := make(map[string]interface{})
+	for key, raw := range template {
+		if s, ok := raw.(string); ok {
+			if strings.HasPrefix(s, "&") || strings.HasPrefix(s, "=") {
+				continue
+			}
+			raw = strings.TrimPrefix(s, "#")
+		} else if !strings.HasPrefix(key, "@") {
+			continue
+		}
+		if _, missing := resolver.Resolve(raw); len(missing) > 0 {
+			patterns[strings.TrimPrefix(key, "@")] = raw
+		}
+	}
+	return patterns
+}
+
+// formatUnresolved renders unresolved placeholders as "id: *model, *subset; ..."
+// for error messages.
+func formatUnresolved(unresolved map[string][]string) string {
+	keys := make([]string, 0, len(unresolved))
+	for key := range unresolved {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		names := make([]string, len(unresolved[key]))
+		for i, n := range unresolved[key] {
+			names[i] = "*" + n
+		}
+		parts = append(parts, fmt.Sprintf("%s: %s", key, strings.Join(names, ", ")))
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePlaceholders(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []Placeholder
+	}{
+		{in: "", want: nil},
+		{in: "no placeholders", want: nil},
+		{in: "SELECT * FROM x", want: nil},
+		{in: "trailing *", want: nil},
+		{in: "*model", want: []Placeholder{{Name: "model", Start: 0, End: 6}}},
+		{in: "DS:*model:*subset", want: []Placeholder{{Name: "model", Start: 3, End: 9}, {Name: "subset", Start: 10, End: 17}}},
+		{in: "*{model}_v1", want: []Placeholder{{Name: "model", Start: 0, End: 8}}},
+		{in: "*model-*{sub set}", want: []Placeholder{{Name: "model", Start: 0, End: 6}, {Name: "sub set", Start: 7, End: 17}}},
+		{in: "*{} and *{open", want: nil},
+		{in: "**model", want: []Placeholder{{Name: "model", Start: 1, End: 7}}},
+	}
+	for _, tt := range tests {
+		if got := ParsePlaceholders(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParsePlaceholders(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// placeholderTestTemplate builds a template whose id is a constant pattern
+// and whose name and @ingest fields use placeholders.
+func placeholderTestTemplate() FormTemplate {
+	template := map[string]interface{}{
+		"id":      "#DS:*model:*{subset}",
+		"type":    "#DS",
+		"model":   "",
+		"subset":  "",
+		"name":    "*model at *stationName",
+		"@ingest": map[string]interface{}{"path": "/data/*model", "files": []interface{}{"*subset.nc"}},
+		"status":  "&getStatuses",
+	}
+	fields := make(map[string]interface{}, len(template))
+	for key := range template {
+		fields[key] = ""
+	}
+	return FormTemplate{
+		Fields:         fields,
+		DisabledFields: map[string]bool{"id": true, "type": true},
+		Patterns:       templatePatterns(template),
+	}
+}
+
+func TestTemplatePatterns(t *testing.T) {
+	want := map[string]interface{}{
+		"id":     "DS:*model:*{subset}",
+		"name":   "*model at *stationName",
+		"ingest": map[string]interface{}{"path": "/data/*model", "files": []interface{}{"*subset.nc"}},
+	}
+	if got := placeholderTestTemplate().Patterns; !reflect.DeepEqual(got, want) {
+		t.Errorf("templatePatterns = %v, want %v", got, want)
+	}
+}
+
+func TestResolvePatterns(t *testing.T) {
+	tests := []struct {
+		name       string
+		values     string
+		want       map[string]interface{}
+		unresolved map[string][]string
+	}{
+		{
+			name:   "all values given",
+			values: `{"model":"HRRR","subset":"METAR"}`,
+			want: map[string]interface{}{
+				"id":     "DS:HRRR:METAR",
+				"name":   "HRRR at *stationName",
+				"ingest": map[string]interface{}{"path": "/data/HRRR", "files": []interface{}{"METAR.nc"}},
+			},
+			unresolved: map[string][]string{},
+		},
+		{
+			name:   "a single-item list and a number",
+			values: `{"model":["HRRR"],"subset":3}`,
+			want: map[string]interface{}{
+				"id":     "DS:HRRR:3",
+				"name":   "HRRR at *stationName",
+				"ingest": map[string]interface{}{"path": "/data/HRRR", "files": []interface{}{"3.nc"}},
+			},
+			unresolved: map[string][]string{},
+		},
+		{
+			name:   "missing, empty and unresolved values",
+			values: `{"model":["HRRR","RAP"],"subset":"*subset"}`,
+			want: map[string]interface{}{
+				"id":     "DS:*model:*{subset}",
+				"name":   "*model at *stationName",
+				"ingest": map[string]interface{}{"path": "/data/*model", "files": []interface{}{"*subset.nc"}},
+			},
+			unresolved: map[string][]string{
+				"id":     {"model", "subset"},
+				"name":   {"model"},
+				"ingest": {"model", "subset"},
+			},
+		},
+	}
+	tmpl := placeholderTestTemplate()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, unresolved := tmpl.ResolvePatterns(decodeJSON(t, tt.values))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolved %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(unresolved, tt.unresolved) {
+				t.Errorf("unresolved %v, want %v", unresolved, tt.unresolved)
+			}
+		})
+	}
+}
+
+func TestResolveDocument(t *testing.T) {
+	tests := []struct {
+		name       string
+		doc        string
+		want       string // the resolved pattern fields
+		unresolved map[string][]string
+	}{
+		{
+			name:       "constant id ignores the submitted value",
+			doc:        `{"id":"DS:edited","model":"HRRR","subset":"METAR"}`,
+			want:       `{"id":"DS:HRRR:METAR","name":"HRRR at *stationName","ingest":{"path":"/data/HRRR","files":["METAR.nc"]}}`,
+			unresolved: map[string][]string{},
+		},
+		{
+			name:       "submitted values keep their text",
+			doc:        `{"model":"HRRR","subset":"METAR","name":"custom *{model}","ingest":{"path":"/mnt/*subset"}}`,
+			want:       `{"id":"DS:HRRR:METAR","name":"custom HRRR","ingest":{"path":"/mnt/METAR"}}`,
+			unresolved: map[string][]string{},
+		},
+		{
+			name:       "unresolved placeholders are reported",
+			doc:        `{"model":"HRRR","name":"*subset only"}`,
+			want:       `{"id":"DS:HRRR:*{subset}","name":"*subset only","ingest":{"path":"/data/HRRR","files":["*subset.nc"]}}`,
+			unresolved: map[string][]string{"id": {"subset"}, "name": {"subset"}, "ingest": {"subset"}},
+		},
+	}
+	tmpl := placeholderTestTemplate()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := decodeJSON(t, tt.doc)
+			got, unresolved := tmpl.ResolveDocument(doc)
+			want := decodeJSON(t, tt.doc)
+			for k, v := range decodeJSON(t, tt.want) {
+				want[k] = v
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("resolved %v, want %v", got, want)
+			}
+			if !reflect.DeepEqual(unresolved, tt.unresolved) {
+				t.Errorf("unresolved %v, want %v", unresolved, tt.unresolved)
+			}
+			if !reflect.DeepEqual(doc, decodeJSON(t, tt.doc)) {
+				t.Errorf("the submitted document was changed to %v", doc)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+)
+
+// Reconcile makes RUNTIME match a directory of JSON documents kept in git,
+// laid out as an unpacked export: one <query-escaped id>.json file per
+// document, in any subdirectories. The documents of the types found in the
+// directory (or the types given) are managed: files without a stored
+// document are created, differing ones updated, and stored documents
+// without a file are moved to the trash. Running it twice changes nothing
+// the second time.
+
+// PlanAction is one step of a reconcile plan.
+type PlanAction struct {
+	ID       string        `json:"id"`
+	Action   string        `json:"action"` // create, update, delete, unchanged or invalid
+	Changes  []FieldChange `json:"changes,omitempty"`
+	Issues   []string      `json:"issues,omitempty"`
+	Warnings []string      `json:"warnings,omitempty"`
+	Error    string        `json:"error,omitempty"`
+
+	document map[string]interface{}
+	expiry   time.Duration
+}
+
+// ReconcilePlan is what it takes to make RUNTIME match a directory.
+type ReconcilePlan struct {
+	Types   []string     `json:"types"`
+	Actions []PlanAction `json:"actions"`
+}
+
+// ReadDocumentDir reads every .json file below dir.
+func ReadDocumentDir(dir string) ([]ArchiveEntry, error) {
+	var entries []ArchiveEntry
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(p, ".json") {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		entry, err := entryFromFile(filepath.ToSlash(p), f)
+		if err != nil {
+			return err
+		}
+		if other, ok := files[entry.ID]; ok {
+			return fmt.Errorf("%s and %s are both document %s", other, p, entry.ID)
+		}
+		files[entry.ID] = p
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+// Counts returns the number of actions of each kind.
+func (p ReconcilePlan) Counts() map[string]int {
+	counts := make(map[string]int)
+	for _, a := range p.Actions {
+		counts[a.Action]++
+	}
+	return counts
+}
+
+// Changed reports whether applying the plan would change anything.
+func (p ReconcilePlan) Changed() bool {
+	c := p.Counts()
+	return c["create"]+c["update"]+c["delete"] > 0
+}
+
+// PlanReconcile compares the directory documents with the stored documents
+// of the managed types. Without types, the types of the directory documents
+// are managed.
+func PlanReconcile(entries []ArchiveEntry, types []string) (ReconcilePlan, error) {
+	if len(types) == 0 {
+		seen := make(map[string]bool)
+		for _, e := range entries {
+			if t, ok := e.Document["type"].(string); ok && t != "" && !seen[t] {
+				seen[t] = true
+				types = append(types, t)
+			}
+		}
+		sort.Strings(types)
+	}
+	plan := ReconcilePlan{Types: types}
+	if len(types) == 0 {
+		return plan, nil
+	}
+	templates, err := GetFormTemplates()
+	if err != nil {
+		return plan, err
+	}
+	stored, err := ExportDocuments(types)
+	if err != nil {
+		return plan, fmt.Errorf("failed to load stored documents: %w", err)
+	}
+	// one connection serves the checks of every file and delete
+	cluster := GetConnection(GetCBCredentials())
+	defer cluster.Close(nil)
+	current := make(map[string]map[string]interface{}, len(stored))
+	for _, e := range stored {
+		current[e.ID] = e.Document
+	}
+	pending := make(map[string]map[string]interface{}, len(entries))
+	for _, e := range entries {
+		pending[e.ID] = e.Document
+	}
+	// stored documents without a file are deleted, so they must not satisfy
+	// the references of the directory documents
+	var deletes []string
+	for _, e := range stored {
+		if _, ok := pending[e.ID]; !ok {
+			deletes = append(deletes, e.ID)
+		}
+	}
+	for _, id := range deletes {
+		pending[id] = nil
+	}
+	for _, e := range entries {
+		a := PlanAction{ID: e.ID, document: e.Document}
+		a.Issues, a.Warnings = validateEntry(cluster, templates, e, pending)
+		a.expiry, _ = expiryFor(templates, e.Document) // checked by validateEntry
+		docType, _ := e.Document["type"].(string)
+		if !containsString(types, docType) {
+			a.Issues = append(a.Issues, fmt.Sprintf("type %q is not one of the managed types", docType))
+		}
+		before, exists := current[e.ID]
+		switch {
+		case len(a.Issues) > 0:
+			a.Action = "invalid"
+		case !exists:
+			a.Action = "create"
+		case reflect.DeepEqual(before, e.Document):
+			a.Action = "unchanged"
+		default:
+			a.Action = "update"
+			a.Changes = DiffFields(before, e.Document)
+		}
+		plan.Actions = append(plan.Actions, a)
+	}
+	for _, id := range deletes {
+		a := PlanAction{ID: id, Action: "delete"}
+		referrers, err := findReferences(cluster, id)
+		if err != nil {
+			return plan, fmt.Errorf("failed to check references to %s: %w", id, err)
+		}
+		for _, ref := range referrers {
+			doc, ok := pending[ref]
+			if ok && (doc == nil || !mentionsID(doc, id)) {
+				// deleted as well, or rewritten without the reference
+				continue
+			}
+			a.Issues = append(a.Issues, fmt.Sprintf("still referenced by %s", ref))
+		}
+		if len(a.Issues) > 0 {
+			a.Action = "invalid"
+		}
+		plan.Actions = append(plan.Actions, a)
+	}
+	sort.SliceStable(plan.Actions, func(i, j int) bool { return plan.Actions[i].ID < plan.Actions[j].ID })
+	return plan, nil
+}
+
+// mentionsID reports whether id is any value within v, as FindReferences
+// looks for it.
+func mentionsID(v interface{}, id string) bool {
+	switch val := v.(type) {
+	case string:
+		return val == id
+	case map[string]interface{}:
+		for _, item := range val {
+			if mentionsID(item, id) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range val {
+			if mentionsID(item, id) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ApplyReconcile carries out a plan. A plan with invalid documents is not
+// applied at all. Deleted documents are moved to the trash.
+func ApplyReconcile(plan *ReconcilePlan) error {
+	if n := plan.Counts()["invalid"]; n > 0 {
+		return fmt.Errorf("%d invalid document(s), nothing was applied", n)
+	}
+	collection := runtimeCollection()
+	failed := 0
+	for i := range plan.Actions {
+		a := &plan.Actions[i]
+		var err error
+		switch a.Action {
+		case "create":
+			_, err = collection.Insert(a.ID, a.document, &gocb.InsertOptions{Expiry: a.expiry})
+		case "update":
+			_, err = collection.Upsert(a.ID, a.document, &gocb.UpsertOptions{Expiry: a.expiry})
+		case "delete":
+			err = DeleteFormData(a.ID, true)
+		default:
+			continue
+		}
+		if err != nil {
+			a.Error = err.Error()
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d change(s) failed", failed)
+	}
+	return nil
+}
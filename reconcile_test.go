@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestMentionsID(t *testing.T) {
+	doc := map[string]interface{}{
+		"type":        "PS",
+		"dataSources": []interface{}{"DS:HRRR", "DS:RAP"},
+		"options":     map[string]interface{}{"fallback": map[string]interface{}{"id": "DS:GFS"}},
+		"count":       float64(2),
+	}
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"DS:HRRR", true},
+		{"DS:RAP", true},
+		{"DS:GFS", true},
+		{"PS", true},
+		{"DS:NAM", false},
+		{"DS", false},
+		{"dataSources", false},
+	}
+	for _, tt := range tests {
+		if got := mentionsID(doc, tt.id); got != tt.want {
+			t.Errorf("mentionsID(doc, %q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/couchbase/gocb/v2"
+)
+
+// A template document may declare which fields hold ids of other documents:
+//
+//	"references": {
+//	    "dataSourceIds": {"type": "DS", "statuses": ["active"]},
+//	    "processSpecId": "PS"
+//	}
+//
+// "type" is the type the referenced documents must have, "collection" where
+// they live (RUNTIME unless given) and "statuses", if set, the statuses they
+// may be in. Fields filled by an id lookup (&getDataSourceId,
+// &getProcessSpecIds, &getIngestDocumentIds) and job_spec_ids are references
+// without having to be declared.
+
+// ReferenceSpec describes the documents a reference field may point to.
+type ReferenceSpec struct {
+	Type       string   `json:"type"`
+	Collection string   `json:"collection,omitempty"`
+	Statuses   []string `json:"statuses,omitempty"`
+}
+
+// implicitReferences are the references of the id lookup functions.
+var implicitReferences = map[string]ReferenceSpec{
+	"getDataSourceId":      {Type: "DS", Collection: "RUNTIME"},
+	"getProcessSpecIds":    {Type: "PS", Collection: "RUNTIME"},
+	"getIngestDocumentIds": {Type: "IS", Collection: "RUNTIME"},
+}
+
+// jobSpecReference is the reference of the job_spec_ids field, whose options
+// come from the JOB documents in COMMON.
+var jobSpecReference = ReferenceSpec{Type: "JOB", Collection: "COMMON"}
+
+// parseReferences reads the "references" object of a template document and
+// adds the implicit references of its id lookup fields.
+func parseReferences(common map[string]interface{}, functions map[string]string) map[string]ReferenceSpec {
+	refs := make(map[string]ReferenceSpec)
+	for key, fn := range functions {
+		if spec, ok := implicitReferences[fn]; ok {
+			refs[key] = spec
+		}
+	}
+	if template, ok := common["template"].(map[string]interface{}); ok {
+		if _, ok := template["job_spec_ids"]; ok {
+			refs["job_spec_ids"] = jobSpecReference
+		}
+	}
+	raw, _ := common["references"].(map[string]interface{})
+	for key, v := range raw {
+		var spec ReferenceSpec
+		switch val := v.(type) {
+		case string:
+			spec.Type = val
+		case map[string]interface{}:
+			spec.Type, _ = val["type"].(string)
+			spec.Collection, _ = val["collection"].(string)
+			statuses, _ := val["statuses"].([]interface{})
+			for _, s := range statuses {
+				spec.Statuses = append(spec.Statuses, fmt.Sprintf("%v", s))
+			}
+		default:
+			continue
+		}
+		if spec.Collection == "" {
+			spec.Collection = "RUNTIME"
+		}
+		refs[key] = spec
+	}
+	return refs
+}
+
+// referencedIDs returns the ids held by a reference field value.
+func referencedIDs(v interface{}) []string {
+	switch val := v.(type) {
+	case string:
+		if val == "" {
+			return nil
+		}
+		return []string{val}
+	case []interface{}:
+		ids := make([]string, 0, len(val))
+		for _, item := range val {
+			if s, ok := item.(string); ok && s != "" {
+				ids = append(ids, s)
+			}
+		}
+		return ids
+	case []string:
+		return val
+	}
+	return nil
+}
+
+// referencedDocument is what the integrity check needs of a referenced
+// document.
+type referencedDocument struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+}
+
+// lookupReferencedDocuments fetches the type and status of the given ids in a
+// collection. Ids that do not exist are absent from the result.
+func lookupReferencedDocuments(cluster *gocb.Cluster, collection string, ids []string) (map[string]referencedDocument, error) {
+	if !isCollectionName(collection) {
+		return nil, fmt.Errorf("invalid collection name %q", collection)
+	}
+	query := fmt.Sprintf("SELECT meta(d).id AS id, d.type, d.status FROM vxdata._default.%s d USE KEYS $ids", collection)
+	result, err := cluster.Query(query, &gocb.QueryOptions{NamedParameters: map[string]interface{}{"ids": ids}})
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]referencedDocument, len(ids))
+	for result.Next() {
+		var row referencedDocument
+		if err := result.Row(&row); err == nil {
+			found[row.ID] = row
+		}
+	}
+	return found, nil
+}
+
+// CheckReferences verifies that every id in the reference fields of doc
+// exists, has the expected type and, where the template restricts it, an
+// allowed status. pending holds RUNTIME documents, by id, that are written
+// together with doc and count as existing; a nil document is being deleted
+// and counts as missing.
+func (t FormTemplate) CheckReferences(cluster *gocb.Cluster, doc map[string]interface{}, pending map[string]map[string]interface{}) error {
+	keys := make([]string, 0, len(t.References))
+	for key := range t.References {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var problems []string
+	for _, key := range keys {
+		spec := t.References[key]
+		ids := referencedIDs(doc[key])
+		if len(ids) == 0 {
+			continue
+		}
+		found := make(map[string]referencedDocument, len(ids))
+		var stored []string
+		for _, id := range ids {
+			if p, ok := pending[id]; ok && spec.Collection == "RUNTIME" {
+				if p == nil {
+					continue
+				}
+				ref := referencedDocument{ID: id}
+				ref.Type, _ = p["type"].(string)
+				ref.Status, _ = p["status"].(string)
+				found[id] = ref
+			} else {
+				stored = append(stored, id)
+			}
+		}
+		if len(stored) > 0 {
+			existing, err := lookupReferencedDocuments(cluster, spec.Collection, stored)
+			if err != nil {
+				return fmt.Errorf("failed to check references of %s: %w", key, err)
+			}
+			for id, ref := range existing {
+				found[id] = ref
+			}
+		}
+		for _, id := range ids {
+			ref, ok := found[id]
+			switch {
+			case !ok:
+				problems = append(problems, fmt.Sprintf("%s: %s does not exist", key, id))
+			case spec.Type != "" && ref.Type != spec.Type:
+				problems = append(problems, fmt.Sprintf("%s: %s is a %s, not a %s", key, id, ref.Type, spec.Type))
+			case len(spec.Statuses) > 0 && !containsString(spec.Statuses, ref.Status):
+				problems = append(problems, fmt.Sprintf("%s: %s has status %q, expected one of %s", key, id, ref.Status, strings.Join(spec.Statuses, ", ")))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid references: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isCollectionName reports whether name can be used as a collection in a
+// query: letters, digits and underscores only.
+func isCollectionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isPlaceholderChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
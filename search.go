@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// Search lists RUNTIME documents a page at a time. The words of q must all
+// appear in the id, ignoring case; the common fields filter on equality.
+
+// searchFields are the common fields that can be filtered and sorted on and
+// that are shown for every document.
+var searchFields = []string{"type", "status", "subset", "subType", "region"}
+
+const (
+	defaultSearchPageSize = 25
+	maxSearchPageSize     = 200
+)
+
+// SearchQuery is a search request.
+type SearchQuery struct {
+	Q        string            `json:"q"`
+	Filters  map[string]string `json:"filters"`
+	Sort     string            `json:"sort"`  // id or one of searchFields
+	Order    string            `json:"order"` // asc or desc
+	Page     int               `json:"page"`  // from 1
+	PageSize int               `json:"pageSize"`
+}
+
+// SearchResult is one page of search results.
+type SearchResult struct {
+	Total     int                      `json:"total"`
+	Page      int                      `json:"page"`
+	PageSize  int                      `json:"pageSize"`
+	Columns   []string                 `json:"columns"`
+	Documents []map[string]interface{} `json:"documents"`
+}
+
+// likeEscaper escapes the LIKE wildcards.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// likePattern returns a lower case LIKE pattern matching s anywhere.
+func likePattern(s string) string {
+	return "%" + likeEscaper.Replace(strings.ToLower(s)) + "%"
+}
+
+// likePrefix returns a lower case LIKE pattern matching values starting
+// with s.
+func likePrefix(s string) string {
+	return likeEscaper.Replace(strings.ToLower(s)) + "%"
+}
+
+// normalize fills in the defaults and checks the sort.
+func (q *SearchQuery) normalize() error {
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	if q.PageSize < 1 {
+		q.PageSize = defaultSearchPageSize
+	}
+	if q.PageSize > maxSearchPageSize {
+		q.PageSize = maxSearchPageSize
+	}
+	if q.Sort == "" {
+		q.Sort = "id"
+	}
+	if q.Sort != "id" && !containsString(searchFields, q.Sort) {
+		return fmt.Errorf("cannot sort on %q", q.Sort)
+	}
+	switch strings.ToLower(q.Order) {
+	case "", "asc":
+		q.Order = "ASC"
+	case "desc":
+		q.Order = "DESC"
+	default:
+		return fmt.Errorf("invalid order %q", q.Order)
+	}
+	for key := range q.Filters {
+		if !containsString(searchFields, key) {
+			return fmt.Errorf("cannot filter on %q", key)
+		}
+	}
+	return nil
+}
+
+// SearchDocuments returns the page of RUNTIME documents matching q.
+func SearchDocuments(q SearchQuery) (SearchResult, error) {
+	if err := q.normalize(); err != nil {
+		return SearchResult{}, err
+	}
+	result := SearchResult{Page: q.Page, PageSize: q.PageSize, Columns: searchFields}
+	conditions := []string{"TRUE"}
+	params := map[string]interface{}{}
+	for i, word := range strings.Fields(q.Q) {
+		name := fmt.Sprintf("w%d", i)
+		conditions = append(conditions, fmt.Sprintf("LOWER(meta(r).id) LIKE $%s", name))
+		params[name] = likePattern(word)
+	}
+	for _, key := range searchFields {
+		if value := q.Filters[key]; value != "" {
+			conditions = append(conditions, fmt.Sprintf("r.%s = $%s", key, key))
+			params[key] = value
+		}
+	}
+	where := strings.Join(conditions, " AND ")
+	cluster := GetConnection(GetCBCredentials())
+
+	countResult, err := cluster.Query("SELECT RAW COUNT(*) FROM vxdata._default.RUNTIME r WHERE "+where,
+		&gocb.QueryOptions{NamedParameters: params})
+	if err != nil {
+		return result, fmt.Errorf("failed to count documents: %w", err)
+	}
+	if err := countResult.One(&result.Total); err != nil {
+		return result, fmt.Errorf("failed to count documents: %w", err)
+	}
+
+	order := "meta(r).id " + q.Order
+	if q.Sort != "id" {
+		order = fmt.Sprintf("r.%s %s, meta(r).id", q.Sort, q.Order)
+	}
+	columns := []string{"meta(r).id AS id"}
+	for _, key := range searchFields {
+		columns = append(columns, "r."+key)
+	}
+	params["limit"] = q.PageSize
+	params["offset"] = (q.Page - 1) * q.PageSize
+	query := "SELECT " + strings.Join(columns, ", ") + " FROM vxdata._default.RUNTIME r WHERE " + where +
+		" ORDER BY " + order + " LIMIT $limit OFFSET $offset"
+	rows, err := cluster.Query(query, &gocb.QueryOptions{NamedParameters: params})
+	if err != nil {
+		return result, fmt.Errorf("failed to search documents: %w", err)
+	}
+	result.Documents = []map[string]interface{}{}
+	for rows.Next() {
+		var row map[string]interface{}
+		if err := rows.Row(&row); err != nil {
+			return result, fmt.Errorf("failed to decode a document: %w", err)
+		}
+		result.Documents = append(result.Documents, row)
+	}
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("failed to search documents: %w", err)
+	}
+	return result, nil
+}
+
+// searchQueryFromRequest reads a SearchQuery from the query string.
+func searchQueryFromRequest(c *gin.Context) SearchQuery {
+	q := SearchQuery{
+		Q:       c.Query("q"),
+		Filters: make(map[string]string),
+		Sort:    c.Query("sort"),
+		Order:   c.Query("order"),
+	}
+	q.Page, _ = strconv.Atoi(c.Query("page"))
+	q.PageSize, _ = strconv.Atoi(c.Query("pageSize"))
+	for _, key := range searchFields {
+		if value := c.Query(key); value != "" {
+			q.Filters[key] = value
+		}
+	}
+	return q
+}
+
+// searchHandler serves GET /api/v1/search?q=&type=&status=&subset=&subType=
+// &region=&sort=&order=&page=&pageSize=.
+func searchHandler(c *gin.Context) {
+	q := searchQueryFromRequest(c)
+	if err := q.normalize(); err != nil {
+		c.String(http.StatusBadRequest, fmt.Sprintf("Error: %v", err))
+		return
+	}
+	result, err := SearchDocuments(q)
+	if err != nil {
+		log.Printf("Search failed: %v", err)
+		c.String(http.StatusInternalServerError, "Search failed")
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func searchPage(c *gin.Context) {
+	data := topNavData()
+	data["columns"] = searchFields
+	c.HTML(http.StatusOK, "search.html", data)
+}
@@ -0,0 +1,120 @@
+// Typeahead selectors for the id lookups. A <select data-lookup="getDataSourceId">
+// starts without options; a search box above it fetches matching ids from
+// /api/v1/lookup/<name> a page at a time, and choosing one adds it to the
+// select as a selected option. The select keeps working like any other, so
+// the code reading the form needs no changes.
+
+function attachTypeahead(sel) {
+    const name = sel.dataset.lookup;
+    const wrapper = document.createElement('div');
+    wrapper.className = 'position-relative mb-1';
+    const input = document.createElement('input');
+    input.type = 'search';
+    input.className = 'form-control form-control-sm';
+    input.placeholder = 'Type to search';
+    input.setAttribute('aria-label', 'Search ' + sel.name);
+    input.setAttribute('autocomplete', 'off');
+    const menu = document.createElement('div');
+    menu.className = 'list-group position-absolute w-100 shadow-sm';
+    menu.style.zIndex = 1050;
+    menu.style.maxHeight = '16em';
+    menu.style.overflowY = 'auto';
+    menu.style.display = 'none';
+    wrapper.appendChild(input);
+    wrapper.appendChild(menu);
+    sel.parentNode.insertBefore(wrapper, sel);
+
+    let timer = null;
+    let offset = 0;
+
+    function load(append) {
+        const params = new URLSearchParams({ q: input.value, limit: 20, offset: offset });
+        fetch('/api/v1/lookup/' + encodeURIComponent(name) + '?' + params.toString())
+            .then(res => res.ok ? res.json() : res.text().then(msg => Promise.reject(msg)))
+            .then(page => {
+                if (!append) menu.innerHTML = '';
+                const more = menu.querySelector('.typeahead-more');
+                if (more) more.remove();
+                page.items.forEach(function (value) {
+                    const item = document.createElement('button');
+                    item.type = 'button';
+                    item.className = 'list-group-item list-group-item-action py-1';
+                    item.textContent = value;
+                    item.onmousedown = function (e) {
+                        e.preventDefault(); // keep the focus in the search box
+                        choose(value);
+                    };
+                    menu.appendChild(item);
+                });
+                if (page.more) {
+                    const item = document.createElement('button');
+                    item.type = 'button';
+                    item.className = 'list-group-item list-group-item-action py-1 text-muted typeahead-more';
+                    item.textContent = 'More…';
+                    item.onmousedown = function (e) {
+                        e.preventDefault();
+                        offset += page.limit;
+                        load(true);
+                    };
+                    menu.appendChild(item);
+                }
+                if (!menu.children.length) {
+                    menu.innerHTML = '<div class="list-group-item py-1 text-muted">No matches</div>';
+                }
+                menu.style.display = '';
+            })
+            .catch(err => console.log('Lookup failed:', err));
+    }
+
+    function choose(value) {
+        if (!sel.multiple) sel.innerHTML = '';
+        let opt = Array.from(sel.options).find(o => o.value === value);
+        if (!opt) {
+            opt = new Option(value, value);
+            sel.add(opt);
+        }
+        opt.selected = true;
+        sel.dispatchEvent(new Event('change', { bubbles: true }));
+        input.value = '';
+        menu.style.display = 'none';
+    }
+
+    input.addEventListener('input', function () {
+        clearTimeout(timer);
+        timer = setTimeout(function () {
+            offset = 0;
+            load(false);
+        }, 250);
+    });
+    input.addEventListener('focus', function () {
+        offset = 0;
+        load(false);
+    });
+    input.addEventListener('blur', function () {
+        menu.style.display = 'none';
+    });
+    input.addEventListener('keydown', function (e) {
+        if (e.key === 'Escape') menu.style.display = 'none';
+        if (e.key === 'Enter') {
+            // take the first match rather than submitting the form
+            e.preventDefault();
+            const first = menu.querySelector('button:not(.typeahead-more)');
+            if (first) choose(first.textContent);
+        }
+    });
+}
+
+// setLookupValues makes values (a list or a single id) the selected options
+// of a typeahead select, e.g. when a document is retrieved.
+function setLookupValues(sel, values) {
+    sel.innerHTML = '';
+    if (!sel.multiple) sel.add(new Option('', ''));
+    [].concat(values).forEach(function (value) {
+        if (value === null || value === undefined || value === '') return;
+        sel.add(new Option(value, value, true, true));
+    });
+}
+
+window.addEventListener('DOMContentLoaded', function () {
+    document.querySelectorAll('select[data-lookup]').forEach(attachTypeahead);
+});
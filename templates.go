@@ -0,0 +1,345 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/couchbase/gocb/v2"
+)
+
+// Template documents live in COMMON with ids ending in TEMPLATE. A template
+// may build on others:
+//
+//	"extends": "BASE_RUNTIME"            // templateName of the base template
+//	"includes": ["status", "ttl"]        // fragmentNames, applied in order
+//
+// Fragments are COMMON documents with ids ending in FRAGMENT, carrying a
+// "fragmentName" and the same "template", "fieldKinds", "visibleWhen" and
+// "dependentOptions" objects as a template (and may include other fragments).
+// The base is applied first, then the fragments, then the template itself, so
+// a later value overrides an earlier one and a null value removes the field.
+// Templates marked "abstract": true are only used as bases and are not offered
+// as forms.
+
+// mergedObjects are the template document objects merged field by field.
+var mergedObjects = []string{"template", "fieldKinds", "visibleWhen", "dependentOptions"}
+
+// queryCommonDocuments returns the COMMON documents whose id ends with suffix.
+func queryCommonDocuments(suffix string) ([]map[string]interface{}, error) {
+	cluster := GetConnection(GetCBCredentials())
+	query := fmt.Sprintf("SELECT meta().id AS docId, * FROM vxdata._default.COMMON WHERE meta().id like '%%%s'", suffix)
+	result, err := cluster.Query(query, &gocb.QueryOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var docs []map[string]interface{}
+	for result.Next() {
+		var row map[string]interface{}
+		if err := result.Row(&row); err != nil {
+			continue
+		}
+		common, ok := row["COMMON"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if id, ok := row["docId"].(string); ok {
+			common["docId"] = id
+		}
+		docs = append(docs, common)
+	}
+	return docs, nil
+}
+
+// GetRawTemplateDocuments returns the template documents as stored, before
+// inheritance is applied.
+func GetRawTemplateDocuments() ([]map[string]interface{}, error) {
+	return queryCommonDocuments("TEMPLATE")
+}
+
+// GetTemplateFragments returns the fragment documents keyed by fragmentName.
+func GetTemplateFragments() (map[string]map[string]interface{}, error) {
+	docs, err := queryCommonDocuments("FRAGMENT")
+	if err != nil {
+		return nil, err
+	}
+	fragments := make(map[string]map[string]interface{}, len(docs))
+	for _, doc := range docs {
+		if name, ok := doc["fragmentName"].(string); ok {
+			fragments[name] = doc
+		}
+	}
+	return fragments, nil
+}
+
+// GetTemplateDocuments returns every template document with its base template
+// and fragments merged in. Templates whose inheritance cannot be resolved are
+// logged and left out.
+func GetTemplateDocuments() ([]map[string]interface{}, error) {
+	raw, err := GetRawTemplateDocuments()
+	if err != nil {
+		return nil, err
+	}
+	fragments, err := GetTemplateFragments()
+	if err != nil {
+		return nil, err
+	}
+	resolver := newTemplateResolver(raw, fragments)
+	docs := make([]map[string]interface{}, 0, len(raw))
+	for _, doc := range raw {
+		merged, err := resolver.resolve(doc)
+		if err != nil {
+			log.Printf("Error resolving template %v: %v", doc["templateName"], err)
+			continue
+		}
+		docs = append(docs, merged)
+	}
+	return docs, nil
+}
+
+// templateResolver merges templates with their bases and fragments.
+type templateResolver struct {
+	templates map[string]map[string]interface{}
+	fragments map[string]map[string]interface{}
+}
+
+func newTemplateResolver(raw []map[string]interface{}, fragments map[string]map[string]interface{}) templateResolver {
+	templates := make(map[string]map[string]interface{}, len(raw))
+	for _, doc := range raw {
+		if name, ok := doc["templateName"].(string); ok {
+			templates[name] = doc
+		}
+	}
+	return templateResolver{templates: templates, fragments: fragments}
+}
+
+func (r templateResolver) resolve(doc map[string]interface{}) (map[string]interface{}, error) {
+	return r.resolveDocument(doc, nil)
+}
+
+// resolveDocument merges doc over its base and fragments. path is the chain
+// of templates and fragments being resolved, used to detect cycles.
+func (r templateResolver) resolveDocument(doc map[string]interface{}, path []string) (map[string]interface{}, error) {
+	name := documentLabel(doc)
+	for _, p := range path {
+		if p == name {
+			return nil, fmt.Errorf("inheritance cycle: %s", strings.Join(append(path, name), " -> "))
+		}
+	}
+	path = append(path, name)
+
+	merged := make(map[string]interface{})
+	if base, ok := doc["extends"].(string); ok && base != "" {
+		parent, ok := r.templates[base]
+		if !ok {
+			return nil, fmt.Errorf("%s extends unknown template %s", name, base)
+		}
+		resolvedParent, err := r.resolveDocument(parent, path)
+		if err != nil {
+			return nil, err
+		}
+		mergeTemplateDocument(merged, resolvedParent)
+		// abstract, revision and migrations belong to the base itself, not
+		// to what extends it
+		delete(merged, "abstract")
+		delete(merged, "revision")
+		delete(merged, "migrations")
+	}
+	includes, _ := doc["includes"].([]interface{})
+	for _, inc := range includes {
+		fragmentName := fmt.Sprintf("%v", inc)
+		fragment, ok := r.fragments[fragmentName]
+		if !ok {
+			return nil, fmt.Errorf("%s includes unknown fragment %s", name, fragmentName)
+		}
+		resolvedFragment, err := r.resolveDocument(fragment, path)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range mergedObjects {
+			if obj, ok := resolvedFragment[key].(map[string]interface{}); ok {
+				mergeObject(merged, key, obj)
+			}
+		}
+	}
+	mergeTemplateDocument(merged, doc)
+	delete(merged, "extends")
+	delete(merged, "includes")
+	return merged, nil
+}
+
+// documentLabel names a template or fragment in error messages and cycle
+// detection.
+func documentLabel(doc map[string]interface{}) string {
+	if name, ok := doc["templateName"].(string); ok {
+		return name
+	}
+	if name, ok := doc["fragmentName"].(string); ok {
+		return "fragment:" + name
+	}
+	return fmt.Sprintf("%v", doc["docId"])
+}
+
+// mergeTemplateDocument merges src over dst: the merged objects are combined
+// field by field, every other key is replaced.
+func mergeTemplateDocument(dst, src map[string]interface{}) {
+	for key, value := range src {
+		if obj, ok := value.(map[string]interface{}); ok && isMergedObject(key) {
+			mergeObject(dst, key, obj)
+			continue
+		}
+		dst[key] = value
+	}
+}
+
+func isMergedObject(key string) bool {
+	for _, k := range mergedObjects {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeObject merges the fields of src into the object dst[key]. A null field
+// in src removes the field.
+func mergeObject(dst map[string]interface{}, key string, src map[string]interface{}) {
+	target, ok := dst[key].(map[string]interface{})
+	if !ok {
+		target = make(map[string]interface{}, len(src))
+	} else {
+		// copy, so that a base shared by several templates is never modified
+		copied := make(map[string]interface{}, len(target))
+		for k, v := range target {
+			copied[k] = v
+		}
+		target = copied
+	}
+	for field, value := range src {
+		if value == nil {
+			delete(target, field)
+			continue
+		}
+		target[field] = value
+	}
+	dst[key] = target
+}
+
+// GetRawTemplateDocument returns a single stored template document and its
+// CAS.
+func GetRawTemplateDocument(docID string) (map[string]interface{}, gocb.Cas, error) {
+	cluster := GetConnection(GetCBCredentials())
+	collection := cluster.Bucket(GetCBCredentials().CBBucket).Collection("COMMON")
+	getResult, err := collection.Get(docID, &gocb.GetOptions{})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to retrieve template: %w", err)
+	}
+	var doc map[string]interface{}
+	if err := getResult.Content(&doc); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode template: %w", err)
+	}
+	return doc, getResult.Cas(), nil
+}
+
+// templateRevisionID is the COMMON id under which a previous revision of a
+// template is kept. It does not end in TEMPLATE, so it is never loaded as a
+// form.
+func templateRevisionID(docID string, revision int) string {
+	return fmt.Sprintf("%s:REV:%d", docID, revision)
+}
+
+// templateRevision returns the "revision" of a template document, 0 if unset.
+func templateRevision(doc map[string]interface{}) int {
+	if r, ok := doc["revision"].(float64); ok {
+		return int(r)
+	}
+	if r, ok := doc["revision"].(int); ok {
+		return r
+	}
+	return 0
+}
+
+// errTemplateConflict is returned when a template was saved by someone else
+// since the editor loaded it.
+var errTemplateConflict = errors.New("template was changed by someone else")
+
+// SaveTemplateDocument stores a template document in COMMON with the next
+// revision number, keeping the stored revision it replaces under
+// templateRevisionID. baseRevision is the revision the editor started from;
+// the save is refused if the stored template has moved on since.
+func SaveTemplateDocument(docID string, doc map[string]interface{}, baseRevision int) (int, error) {
+	if !strings.HasSuffix(docID, "TEMPLATE") {
+		return 0, fmt.Errorf("template ids must end with TEMPLATE")
+	}
+	cluster := GetConnection(GetCBCredentials())
+	collection := cluster.Bucket(GetCBCredentials().CBBucket).Collection("COMMON")
+
+	stored, cas, err := GetRawTemplateDocument(docID)
+	revision := 0
+	if err == nil {
+		revision = templateRevision(stored)
+		if revision != baseRevision {
+			return 0, fmt.Errorf("%w: %s is at revision %d, editing %d", errTemplateConflict, docID, revision, baseRevision)
+		}
+		if _, err := collection.Upsert(templateRevisionID(docID, revision), stored, &gocb.UpsertOptions{}); err != nil {
+			return 0, fmt.Errorf("failed to keep revision %d: %w", revision, err)
+		}
+	} else if baseRevision != 0 {
+		if errors.Is(err, gocb.ErrDocumentNotFound) {
+			return 0, fmt.Errorf("%w: %s was deleted", errTemplateConflict, docID)
+		}
+		return 0, err
+	}
+
+	saved := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		saved[k] = v
+	}
+	delete(saved, "docId")
+	saved["revision"] = revision + 1
+	if cas != 0 {
+		_, err = collection.Replace(docID, saved, &gocb.ReplaceOptions{Cas: cas})
+	} else {
+		_, err = collection.Insert(docID, saved, &gocb.InsertOptions{})
+	}
+	if errors.Is(err, gocb.ErrCasMismatch) || errors.Is(err, gocb.ErrDocumentExists) {
+		return 0, fmt.Errorf("%w: %s was saved while this revision was stored", errTemplateConflict, docID)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to save template: %w", err)
+	}
+	return revision + 1, nil
+}
+
+// BuildCandidateTemplate builds the form of an unsaved template document,
+// resolving its inheritance against the stored templates and fragments.
+func BuildCandidateTemplate(doc map[string]interface{}) (FormTemplate, error) {
+	raw, err := GetRawTemplateDocuments()
+	if err != nil {
+		return FormTemplate{}, err
+	}
+	fragments, err := GetTemplateFragments()
+	if err != nil {
+		return FormTemplate{}, err
+	}
+	merged, err := newTemplateResolver(withCandidate(raw, doc), fragments).resolve(doc)
+	if err != nil {
+		return FormTemplate{}, err
+	}
+	return BuildFormTemplate(merged)
+}
+
+// withCandidate returns raw with the stored document of the same docId
+// replaced by doc (or doc appended when it is new).
+func withCandidate(raw []map[string]interface{}, doc map[string]interface{}) []map[string]interface{} {
+	docID, _ := doc["docId"].(string)
+	out := make([]map[string]interface{}, 0, len(raw)+1)
+	for _, r := range raw {
+		if id, _ := r["docId"].(string); id == docID {
+			continue
+		}
+		out = append(out, r)
+	}
+	return append(out, doc)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// inheritanceTestResolver returns a resolver over a small set of templates
+// and fragments, decoded fresh for each test.
+func inheritanceTestResolver(t *testing.T) templateResolver {
+	t.Helper()
+	raw := []map[string]interface{}{
+		decodeJSON(t, `{
+			"templateName": "BASE",
+			"abstract": true,
+			"revision": 4,
+			"migrations": [{"toRevision": 4, "rules": [{"op": "remove", "field": "obsolete"}]}],
+			"docType": "base",
+			"template": {"id": "#*type:*name", "type": "", "name": "", "status": "&getStatuses", "note": ""},
+			"fieldKinds": {"validFrom": "epoch"}
+		}`),
+		decodeJSON(t, `{
+			"templateName": "DS",
+			"extends": "BASE",
+			"includes": ["ttl", "owner"],
+			"docType": "ds",
+			"template": {"type": "#DS", "note": null, "model": "&getModels"},
+			"visibleWhen": {"expires": "ttlTier != ''"}
+		}`),
+		decodeJSON(t, `{"templateName": "LOOP_A", "extends": "LOOP_B", "template": {}}`),
+		decodeJSON(t, `{"templateName": "LOOP_B", "extends": "LOOP_A", "template": {}}`),
+		decodeJSON(t, `{"templateName": "SELF_INCLUDE", "includes": ["self"], "template": {}}`),
+		decodeJSON(t, `{"templateName": "ORPHAN", "extends": "MISSING", "template": {}}`),
+		decodeJSON(t, `{"templateName": "NO_FRAGMENT", "includes": ["missing"], "template": {}}`),
+	}
+	fragments := map[string]map[string]interface{}{
+		"ttl": decodeJSON(t, `{
+			"fragmentName": "ttl",
+			"template": {"ttlTier": "&getTTLTier", "expires": "", "owner": "ttl"},
+			"fieldKinds": {"expires": "duration"}
+		}`),
+		"owner": decodeJSON(t, `{
+			"fragmentName": "owner",
+			"includes": ["contact"],
+			"template": {"owner": "", "status": "&getDataSourceStatuses"}
+		}`),
+		"contact": decodeJSON(t, `{"fragmentName": "contact", "template": {"email": ""}}`),
+		"self":    decodeJSON(t, `{"fragmentName": "self", "includes": ["self"], "template": {}}`),
+	}
+	return newTemplateResolver(raw, fragments)
+}
+
+func TestResolveTemplateInheritance(t *testing.T) {
+	r := inheritanceTestResolver(t)
+	merged, err := r.resolve(r.templates["DS"])
+	if err != nil {
+		t.Fatalf("resolve failed: %v", err)
+	}
+	// the base first, then the fragments in order, then the template; a null
+	// removes the inherited note
+	want := decodeJSON(t, `{
+		"templateName": "DS",
+		"docType": "ds",
+		"template": {
+			"id": "#*type:*name", "type": "#DS", "name": "", "status": "&getDataSourceStatuses",
+			"model": "&getModels", "ttlTier": "&getTTLTier", "expires": "", "owner": "", "email": ""
+		},
+		"fieldKinds": {"validFrom": "epoch", "expires": "duration"},
+		"visibleWhen": {"expires": "ttlTier != ''"}
+	}`)
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("merged template is %v, want %v", merged, want)
+	}
+	// abstract, revision and migrations stay with the base
+	base, err := r.resolve(r.templates["BASE"])
+	if err != nil {
+		t.Fatalf("resolve failed: %v", err)
+	}
+	for _, key := range []string{"abstract", "revision", "migrations"} {
+		if _, ok := base[key]; !ok {
+			t.Errorf("the base lost its %s", key)
+		}
+	}
+	// the base shared with other templates is not modified by the merge
+	if note, ok := r.templates["BASE"]["template"].(map[string]interface{})["note"]; !ok || note != "" {
+		t.Errorf("the base template was modified: %v", r.templates["BASE"]["template"])
+	}
+}
+
+func TestResolveTemplateErrors(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{template: "LOOP_A", want: "inheritance cycle: LOOP_A -> LOOP_B -> LOOP_A"},
+		{template: "SELF_INCLUDE", want: "inheritance cycle: SELF_INCLUDE -> fragment:self -> fragment:self"},
+		{template: "ORPHAN", want: "ORPHAN extends unknown template MISSING"},
+		{template: "NO_FRAGMENT", want: "NO_FRAGMENT includes unknown fragment missing"},
+	}
+	r := inheritanceTestResolver(t)
+	for _, tt := range tests {
+		_, err := r.resolve(r.templates[tt.template])
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("resolving %s failed with %v, want %q", tt.template, err, tt.want)
+		}
+	}
+}
+
+func TestMergeObject(t *testing.T) {
+	tests := []struct {
+		name string
+		dst  string
+		src  string
+		want string
+	}{
+		{name: "into nothing", dst: `{}`, src: `{"a":1}`, want: `{"t":{"a":1}}`},
+		{name: "later values win", dst: `{"t":{"a":1,"b":2}}`, src: `{"b":3,"c":4}`, want: `{"t":{"a":1,"b":3,"c":4}}`},
+		{name: "null removes", dst: `{"t":{"a":1,"b":2}}`, src: `{"a":null}`, want: `{"t":{"b":2}}`},
+		{name: "null of a missing field", dst: `{"t":{"a":1}}`, src: `{"z":null}`, want: `{"t":{"a":1}}`},
+		{name: "over a non-object", dst: `{"t":"text"}`, src: `{"a":1}`, want: `{"t":{"a":1}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := decodeJSON(t, tt.dst)
+			var shared map[string]interface{}
+			if obj, ok := dst["t"].(map[string]interface{}); ok {
+				shared = obj
+			}
+			before := decodeJSON(t, tt.dst)
+			mergeObject(dst, "t", decodeJSON(t, tt.src))
+			if want := decodeJSON(t, tt.want); !reflect.DeepEqual(dst, want) {
+				t.Errorf("merged %v, want %v", dst, want)
+			}
+			if shared != nil && !reflect.DeepEqual(shared, before["t"]) {
+				t.Errorf("the original object was changed to %v", shared)
+			}
+		})
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// RUNTIME documents can be exported to, and imported from, a zip or tar.gz
+// archive holding one pretty-printed JSON file per document
+// (<type>/<query-escaped id>.json), or NDJSON with one
+// {"id": ..., "document": ...} object per line.
+
+// ArchiveEntry is one exported document.
+type ArchiveEntry struct {
+	ID       string                 `json:"id"`
+	Document map[string]interface{} `json:"document"`
+}
+
+// Import conflict policies, for documents that already exist.
+const (
+	ConflictSkip      = "skip"
+	ConflictOverwrite = "overwrite"
+	ConflictFail      = "fail"
+)
+
+// ImportResult reports one document of an import.
+type ImportResult struct {
+	ID       string   `json:"id"`
+	Action   string   `json:"action"` // create, replace, skip, invalid, conflict or failed
+	Applied  bool     `json:"applied"`
+	Issues   []string `json:"issues,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// ExportDocuments returns the RUNTIME documents of the given types, by id.
+func ExportDocuments(types []string) ([]ArchiveEntry, error) {
+	cluster := GetConnection(GetCBCredentials())
+	query := "SELECT meta(r).id AS id, r AS document FROM vxdata._default.RUNTIME r WHERE r.type IN $types ORDER BY meta(r).id"
+	result, err := cluster.Query(query, &gocb.QueryOptions{NamedParameters: map[string]interface{}{"types": types}})
+	if err != nil {
+		return nil, err
+	}
+	var entries []ArchiveEntry
+	for result.Next() {
+		var entry ArchiveEntry
+		if err := result.Row(&entry); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// archiveName is the file name of an entry in a zip or tar archive.
+func archiveName(e ArchiveEntry) string {
+	docType, _ := e.Document["type"].(string)
+	if docType == "" {
+		docType = "other"
+	}
+	return docType + "/" + url.QueryEscape(e.ID) + ".json"
+}
+
+// WriteArchive writes entries to w as "zip", "tar" (gzipped) or "ndjson".
+func WriteArchive(w io.Writer, format string, entries []ArchiveEntry) error {
+	switch format {
+	case "ndjson":
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "zip":
+		zw := zip.NewWriter(w)
+		for _, e := range entries {
+			f, err := zw.Create(archiveName(e))
+			if err != nil {
+				return err
+			}
+			if err := writeDocumentJSON(f, e.Document); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	case "tar":
+		gz := gzip.NewWriter(w)
+		tw := tar.NewWriter(gz)
+		for _, e := range entries {
+			var buf bytes.Buffer
+			if err := writeDocumentJSON(&buf, e.Document); err != nil {
+				return err
+			}
+			hdr := &tar.Header{Name: archiveName(e), Mode: 0644, Size: int64(buf.Len()), ModTime: time.Now()}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := tw.Write(buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return gz.Close()
+	}
+	return fmt.Errorf("unknown export format %q", format)
+}
+
+// writeDocumentJSON writes doc indented, with sorted keys, so that exports
+// diff cleanly.
+func writeDocumentJSON(w io.Writer, doc map[string]interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// matchingID checks that the id a document holds, if any, is the id it is
+// stored under.
+func (e ArchiveEntry) matchingID() error {
+	if id, ok := e.Document["id"]; ok && id != e.ID {
+		return fmt.Errorf("the document id %v does not match %s", id, e.ID)
+	}
+	return nil
+}
+
+// entryFromFile decodes an archive file named <type>/<escaped id>.json.
+func entryFromFile(name string, r io.Reader) (ArchiveEntry, error) {
+	id, err := url.QueryUnescape(strings.TrimSuffix(path.Base(name), ".json"))
+	if err != nil {
+		return ArchiveEntry{}, fmt.Errorf("%s: invalid file name: %w", name, err)
+	}
+	var doc map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return ArchiveEntry{}, fmt.Errorf("%s: %w", name, err)
+	}
+	entry := ArchiveEntry{ID: id, Document: doc}
+	if err := entry.matchingID(); err != nil {
+		return ArchiveEntry{}, fmt.Errorf("%s: %w", name, err)
+	}
+	return entry, nil
+}
+
+// ReadArchive decodes a zip, tar, tar.gz or NDJSON export.
+func ReadArchive(data []byte) ([]ArchiveEntry, error) {
+	var entries []ArchiveEntry
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() || !strings.HasSuffix(f.Name, ".json") {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			entry, err := entryFromFile(f.Name, rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+		return entries, nil
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return readTar(gz)
+	case len(data) > 262 && string(data[257:262]) == "ustar":
+		return readTar(bytes.NewReader(data))
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var entry ArchiveEntry
+		if err := json.Unmarshal([]byte(text), &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if entry.ID == "" || entry.Document == nil {
+			return nil, fmt.Errorf("line %d: expected {\"id\": ..., \"document\": ...}", line)
+		}
+		if err := entry.matchingID(); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func readTar(r io.Reader) ([]ArchiveEntry, error) {
+	var entries []ArchiveEntry
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg || !strings.HasSuffix(hdr.Name, ".json") {
+			continue
+		}
+		entry, err := entryFromFile(hdr.Name, tr)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// templateForDocument finds the template a stored document was created from,
+// by its templateName or, for older documents, its type when only one
+// template creates that type.
+func templateForDocument(templates []FormTemplate, doc map[string]interface{}) (FormTemplate, bool) {
+	name, _ := doc["templateName"].(string)
+	if name == "" {
+		docType, _ := doc["type"].(string)
+		t, ok := templatesByType(templates)[docType]
+		return t, ok
+	}
+	for _, t := range templates {
+		if t.TemplateName == name {
+			return t, true
+		}
+	}
+	return FormTemplate{}, false
+}
+
+// validateEntry checks a document from outside the store against its
+// template. Broken references and an invalid TTL tier are issues that keep
+// it from being written; drift from the template, as in the stored
+// documents, only warns. pending are the other documents that are written
+// along with it.
+func validateEntry(cluster *gocb.Cluster, templates []FormTemplate, e ArchiveEntry, pending map[string]map[string]interface{}) (issues, warnings []string) {
+	t, ok := templateForDocument(templates, e.Document)
+	if !ok {
+		return []string{"no template found for this document"}, nil
+	}
+	for _, issue := range t.CheckDrift(e.Document) {
+		warnings = append(warnings, fmt.Sprintf("%s: %s", issue.Field, issue.Message))
+	}
+	if err := t.CheckReferences(cluster, e.Document, pending); err != nil {
+		issues = append(issues, err.Error())
+	}
+	if _, _, err := t.DocumentExpiry(e.Document); err != nil {
+		issues = append(issues, err.Error())
+	}
+	return issues, warnings
+}
+
+// ImportDocuments validates entries against their templates and, unless
+// dryRun is set, writes them to RUNTIME. Invalid documents are never written.
+// Existing documents are handled by policy; with ConflictFail any conflict
+// stops the import before anything is written.
+func ImportDocuments(entries []ArchiveEntry, policy string, dryRun bool) ([]ImportResult, error) {
+	switch policy {
+	case ConflictSkip, ConflictOverwrite, ConflictFail:
+	default:
+		return nil, fmt.Errorf("unknown conflict policy %q", policy)
+	}
+	templates, err := GetFormTemplates()
+	if err != nil {
+		return nil, err
+	}
+	pending := make(map[string]map[string]interface{}, len(entries))
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		pending[e.ID] = e.Document
+		ids = append(ids, e.ID)
+	}
+	// one connection serves the checks of every entry
+	cluster := GetConnection(GetCBCredentials())
+	defer cluster.Close(nil)
+	existing := map[string]referencedDocument{}
+	if len(ids) > 0 {
+		existing, err = lookupReferencedDocuments(cluster, "RUNTIME", ids)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check existing documents: %w", err)
+		}
+	}
+	results := make([]ImportResult, len(entries))
+	conflicts := 0
+	for i, e := range entries {
+		r := ImportResult{ID: e.ID, Action: "create"}
+		r.Issues, r.Warnings = validateEntry(cluster, templates, e, pending)
+		_, exists := existing[e.ID]
+		switch {
+		case len(r.Issues) > 0:
+			r.Action = "invalid"
+		case exists && policy == ConflictSkip:
+			r.Action = "skip"
+		case exists && policy == ConflictFail:
+			r.Action = "conflict"
+			conflicts++
+		case exists:
+			r.Action = "replace"
+		}
+		results[i] = r
+	}
+	if dryRun || conflicts > 0 {
+		return results, nil
+	}
+	collection := cluster.Bucket(GetCBCredentials().CBBucket).Collection("RUNTIME")
+	for i, e := range entries {
+		r := &results[i]
+		expiry, _ := expiryFor(templates, e.Document) // checked by validateEntry
+		var err error
+		switch r.Action {
+		case "create":
+			_, err = collection.Insert(e.ID, e.Document, &gocb.InsertOptions{Expiry: expiry})
+		case "replace":
+			_, err = collection.Upsert(e.ID, e.Document, &gocb.UpsertOptions{Expiry: expiry})
+		default:
+			continue
+		}
+		if err != nil {
+			r.Action = "failed"
+			r.Error = err.Error()
+			continue
+		}
+		r.Applied = true
+	}
+	return results, nil
+}
+
+// importCounts counts the results by action.
+func importCounts(results []ImportResult) map[string]int {
+	counts := make(map[string]int)
+	for _, r := range results {
+		counts[r.Action]++
+	}
+	return counts
+}
+
+// parseTypes splits a comma separated list of document types.
+func parseTypes(s string) []string {
+	var types []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// exportHandler sends the documents of ?types=DS,PS,... as
+// ?format=zip (default), tar or ndjson.
+func exportHandler(c *gin.Context) {
+	types := parseTypes(c.DefaultQuery("types", "DS,PS,IS,JOB"))
+	format := c.DefaultQuery("format", "zip")
+	ext := map[string]string{"zip": "zip", "tar": "tar.gz", "ndjson": "ndjson"}[format]
+	if ext == "" {
+		c.String(http.StatusBadRequest, fmt.Sprintf("Unknown format %q", format))
+		return
+	}
+	entries, err := ExportDocuments(types)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to export documents")
+		return
+	}
+	var buf bytes.Buffer
+	if err := WriteArchive(&buf, format, entries); err != nil {
+		c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to write export: %v", err))
+		return
+	}
+	name := fmt.Sprintf("runtime-%s-%s.%s", strings.Join(types, "-"), time.Now().UTC().Format("20060102T150405Z"), ext)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	c.Data(http.StatusOK, "application/octet-stream", buf.Bytes())
+}
+
+// importHandler imports the uploaded "file" with ?policy=skip|overwrite|fail
+// (skip by default); ?dryRun=true only reports what would happen.
+func importHandler(c *gin.Context) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.String(http.StatusBadRequest, "Missing file")
+		return
+	}
+	f, err := file.Open()
+	if err != nil {
+		c.String(http.StatusBadRequest, "Cannot read file")
+		return
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Cannot read file")
+		return
+	}
+	entries, err := ReadArchive(data)
+	if err != nil {
+		c.String(http.StatusBadRequest, fmt.Sprintf("Invalid archive: %v", err))
+		return
+	}
+	dryRun := c.Query("dryRun") == "true"
+	results, err := ImportDocuments(entries, c.DefaultQuery("policy", ConflictSkip), dryRun)
+	if err != nil {
+		c.String(http.StatusBadRequest, fmt.Sprintf("Error: %v", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"dryRun": dryRun, "counts": importCounts(results), "results": results})
+}
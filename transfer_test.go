@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEntryFromFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		body  string
+		fails bool
+	}{
+		{name: "matching id", file: "DS/DS%3AHRRR.json", body: `{"id":"DS:HRRR","type":"DS"}`},
+		{name: "no id", file: "DS/DS%3AHRRR.json", body: `{"type":"DS"}`},
+		{name: "different id", file: "DS/DS%3AHRRR.json", body: `{"id":"DS:RAP","type":"DS"}`, fails: true},
+		{name: "invalid JSON", file: "DS/DS%3AHRRR.json", body: `{`, fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, err := entryFromFile(tt.file, strings.NewReader(tt.body))
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("entryFromFile succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("entryFromFile failed: %v", err)
+			}
+			if entry.ID != "DS:HRRR" {
+				t.Errorf("entry id is %s, want DS:HRRR", entry.ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// The id lookups can list thousands of documents, so their fields are not
+// rendered with every id as an option. They are typeahead selectors that
+// fetch matching ids a page at a time from /api/v1/lookup/<function>.
+
+// typeaheadLookups maps the id lookup functions to the RUNTIME documents
+// they list.
+var typeaheadLookups = map[string]string{
+	"getDataSourceId":      "r.type = 'DS'",
+	"getProcessSpecIds":    "r.type = 'PS'",
+	"getIngestDocumentIds": "r.type = 'IS' AND r.docType = 'ingest'",
+}
+
+const (
+	defaultLookupLimit = 20
+	maxLookupLimit     = 100
+)
+
+// LookupPage is one page of the values of a lookup function.
+type LookupPage struct {
+	Name   string   `json:"name"`
+	Items  []string `json:"items"`
+	Offset int      `json:"offset"`
+	Limit  int      `json:"limit"`
+	More   bool     `json:"more"`
+}
+
+// isTypeahead reports whether the lookup function fn is rendered as a
+// typeahead selector.
+func isTypeahead(fn string) bool {
+	_, ok := typeaheadLookups[fn]
+	return ok
+}
+
+// LookupValues returns a page of the values of the lookup function name that
+// contain q, ignoring case; values starting with q come first. With prefix
+// set only those are returned.
+func LookupValues(name, q string, prefix bool, offset, limit int) (LookupPage, error) {
+	page := LookupPage{Name: name, Offset: offset, Limit: limit, Items: []string{}}
+	q = strings.ToLower(strings.TrimSpace(q))
+	var items []string
+	if condition, ok := typeaheadLookups[name]; ok {
+		params := map[string]interface{}{
+			"prefix": likePrefix(q),
+			"limit":  limit + 1,
+			"offset": offset,
+		}
+		match := "$prefix"
+		if !prefix {
+			match = "$pattern"
+			params["pattern"] = likePattern(q)
+		}
+		cluster := GetConnection(GetCBCredentials())
+		query := "SELECT RAW meta(r).id FROM vxdata._default.RUNTIME r WHERE " + condition +
+			" AND LOWER(meta(r).id) LIKE " + match +
+			" ORDER BY CASE WHEN LOWER(meta(r).id) LIKE $prefix THEN 0 ELSE 1 END, meta(r).id LIMIT $limit OFFSET $offset"
+		result, err := cluster.Query(query, &gocb.QueryOptions{NamedParameters: params})
+		if err != nil {
+			return page, fmt.Errorf("failed to look up %s: %w", name, err)
+		}
+		for result.Next() {
+			var id string
+			if err := result.Row(&id); err != nil {
+				return page, fmt.Errorf("failed to look up %s: %w", name, err)
+			}
+			items = append(items, id)
+		}
+		if err := result.Err(); err != nil {
+			return page, fmt.Errorf("failed to look up %s: %w", name, err)
+		}
+	} else {
+		if _, ok := namedFunctions[name]; !ok {
+			return page, fmt.Errorf("unknown lookup %s", name)
+		}
+		values, err := CallNamedFunction(name)
+		if err != nil {
+			return page, err
+		}
+		var starts, contains []string
+		for _, v := range values {
+			lower := strings.ToLower(v)
+			switch {
+			case strings.HasPrefix(lower, q):
+				starts = append(starts, v)
+			case !prefix && strings.Contains(lower, q):
+				contains = append(contains, v)
+			}
+		}
+		sort.Strings(starts)
+		sort.Strings(contains)
+		matches := append(starts, contains...)
+		if offset < len(matches) {
+			items = matches[offset:min(len(matches), offset+limit+1)]
+		}
+	}
+	if len(items) > limit {
+		items, page.More = items[:limit], true
+	}
+	page.Items = append(page.Items, items...)
+	return page, nil
+}
+
+// lookupHandler serves GET /api/v1/lookup/:name?q=&match=prefix|substring
+// &limit=&offset=.
+func lookupHandler(c *gin.Context) {
+	name := c.Param("name")
+	if _, ok := namedFunctions[name]; !ok {
+		c.String(http.StatusNotFound, fmt.Sprintf("Unknown lookup %s", name))
+		return
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit < 1 {
+		limit = defaultLookupLimit
+	}
+	limit = min(limit, maxLookupLimit)
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	offset = max(offset, 0)
+	var prefix bool
+	switch c.Query("match") {
+	case "", "substring":
+	case "prefix":
+		prefix = true
+	default:
+		c.String(http.StatusBadRequest, "match must be prefix or substring")
+		return
+	}
+	page, err := LookupValues(name, c.Query("q"), prefix, offset, limit)
+	if err != nil {
+		log.Printf("Lookup failed: %v", err)
+		c.String(http.StatusInternalServerError, "Lookup failed")
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}